@@ -0,0 +1,400 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/hyperjumptech/retter/cache"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// AdminStoreCache is the name of the cache store in the admin API
+	AdminStoreCache = "cache"
+
+	// AdminStoreLastKnownSuccess is the name of the last known success store in the admin API
+	AdminStoreLastKnownSuccess = "last-known-success"
+)
+
+var (
+	adminLog = logrus.WithFields(logrus.Fields{
+		"module": "AdminHTTPHandler",
+		"file":   "Admin.go",
+	})
+)
+
+// AdminEntry describe a stored response in the admin API.
+type AdminEntry struct {
+	Key        string  `json:"key"`
+	Store      string  `json:"store"`
+	AgeSeconds float64 `json:"age-seconds"`
+	TTLSeconds float64 `json:"ttl-seconds"`
+	Size       int64   `json:"size"`
+}
+
+// AdminEntryDetail is a stored response in the admin API, including its headers and body.
+type AdminEntryDetail struct {
+	AdminEntry
+	Code         int         `json:"code"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body-encoding"`
+}
+
+// AdminPurgeResult is the body of a successful purge in the admin API.
+type AdminPurgeResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// NewAdminHTTPHandler create the http.Handler of the admin API for a RETTER handler.
+// Every call to the admin API must bear the token in its Authorization header.
+func NewAdminHTTPHandler(rhh *RetterHTTPHandler, token string) *AdminHTTPHandler {
+	return &AdminHTTPHandler{
+		Retter: rhh,
+		Token:  token,
+	}
+}
+
+// AdminHTTPHandler serve the admin API to inspect and purge what RETTER is serving.
+//
+//	GET    /cache                     list entries, optionally filtered by store, prefix or match (glob)
+//	GET    /cache/entry?key=          an entry's headers and body, from the store query (default cache)
+//	DELETE /cache/entry?key=          delete an entry from both stores
+//	DELETE /cache?prefix= or ?match=  delete every entry whose key has the prefix or match the glob, from both stores
+//	DELETE /cache/tag?tag=            delete every entry tagged with any of the tags, from both stores
+//	POST   /cache/clear               clear both stores
+type AdminHTTPHandler struct {
+	Retter *RetterHTTPHandler
+	Token  string
+}
+
+func (ahh *AdminHTTPHandler) authorized(req *http.Request) bool {
+	if len(ahh.Token) == 0 {
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(ahh.Token)) == 1
+}
+
+// stores return the stores selected by the store query, all of them if there is none.
+func (ahh *AdminHTTPHandler) stores(req *http.Request) (map[string]cache.Store, error) {
+	all := map[string]cache.Store{
+		AdminStoreCache:            ahh.Retter.Cache,
+		AdminStoreLastKnownSuccess: ahh.Retter.LastKnownSuccess,
+	}
+	name := req.URL.Query().Get("store")
+	if len(name) == 0 {
+		return all, nil
+	}
+	if store, ok := all[name]; ok {
+		return map[string]cache.Store{name: store}, nil
+	}
+	return nil, fmt.Errorf("unknown store \"%s\"", name)
+}
+
+// keyMatcher return a function to select keys according to the prefix or match query,
+// a match is a glob where * matches any characters and ? matches a single character.
+func keyMatcher(req *http.Request) (func(key string) bool, error) {
+	prefix := req.URL.Query().Get("prefix")
+	match := req.URL.Query().Get("match")
+	switch {
+	case len(prefix) > 0 && len(match) > 0:
+		return nil, fmt.Errorf("use either prefix or match, not both")
+	case len(prefix) > 0:
+		return func(key string) bool {
+			return strings.HasPrefix(key, prefix)
+		}, nil
+	case len(match) > 0:
+		glob, err := globRegexp(match)
+		if err != nil {
+			return nil, err
+		}
+		return glob.MatchString, nil
+	default:
+		return nil, nil
+	}
+}
+
+// entriesOf return the entries of a store, or an error if the store is not able to list them.
+func entriesOf(name string, store cache.Store) ([]cache.EntryInfo, error) {
+	if lister, ok := store.(cache.Lister); ok {
+		return lister.Entries(), nil
+	}
+	return nil, fmt.Errorf("store \"%s\" is not able to list its entries", name)
+}
+
+func newAdminEntry(name string, info cache.EntryInfo, now time.Time) AdminEntry {
+	entry := AdminEntry{
+		Key:        info.Key,
+		Store:      name,
+		AgeSeconds: now.Sub(info.Stored).Seconds(),
+		TTLSeconds: -1,
+		Size:       info.Size,
+	}
+	if !info.Expires.IsZero() {
+		entry.TTLSeconds = info.Expires.Sub(now).Seconds()
+	}
+	return entry
+}
+
+// ServeHTTP serves the admin API
+func (ahh *AdminHTTPHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if !ahh.authorized(req) {
+		res.Header().Set("WWW-Authenticate", `Bearer realm="retter"`)
+		writeAdminError(res, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	adminLog.Infof("%s %s", req.Method, req.URL.String())
+
+	switch {
+	case req.URL.Path == "/cache" && req.Method == http.MethodGet:
+		ahh.serveList(res, req)
+	case req.URL.Path == "/cache" && req.Method == http.MethodDelete:
+		ahh.servePurge(res, req)
+	case req.URL.Path == "/cache/entry" && req.Method == http.MethodGet:
+		ahh.serveEntry(res, req)
+	case req.URL.Path == "/cache/entry" && req.Method == http.MethodDelete:
+		ahh.serveDelete(res, req)
+	case req.URL.Path == "/cache/tag" && req.Method == http.MethodDelete:
+		ahh.servePurgeTags(res, req)
+	case req.URL.Path == "/cache/clear" && req.Method == http.MethodPost:
+		ahh.serveClear(res, req)
+	case req.URL.Path == "/cache" || req.URL.Path == "/cache/entry" || req.URL.Path == "/cache/tag" || req.URL.Path == "/cache/clear":
+		writeAdminError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", req.Method))
+	default:
+		writeAdminError(res, http.StatusNotFound, fmt.Errorf("%s not found", req.URL.Path))
+	}
+}
+
+func (ahh *AdminHTTPHandler) serveList(res http.ResponseWriter, req *http.Request) {
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	matcher, err := keyMatcher(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	list := make([]AdminEntry, 0)
+	for name, store := range stores {
+		infos, err := entriesOf(name, store)
+		if err != nil {
+			writeAdminError(res, http.StatusNotImplemented, err)
+			return
+		}
+		for _, info := range infos {
+			if matcher == nil || matcher(info.Key) {
+				list = append(list, newAdminEntry(name, info, now))
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Key == list[j].Key {
+			return list[i].Store < list[j].Store
+		}
+		return list[i].Key < list[j].Key
+	})
+	writeAdminJSON(res, http.StatusOK, list)
+}
+
+func (ahh *AdminHTTPHandler) serveEntry(res http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if len(key) == 0 {
+		writeAdminError(res, http.StatusBadRequest, fmt.Errorf("key is required"))
+		return
+	}
+	name := req.URL.Query().Get("store")
+	if len(name) == 0 {
+		name = AdminStoreCache
+	}
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	store := stores[name]
+	tx, ok := store.Get(key, false, 0).(HTTPTransaction)
+	if !ok {
+		writeAdminError(res, http.StatusNotFound, fmt.Errorf("key \"%s\" is not in %s", key, name))
+		return
+	}
+
+	now := time.Now()
+	detail := AdminEntryDetail{
+		AdminEntry: AdminEntry{
+			Key:        key,
+			Store:      name,
+			AgeSeconds: now.Sub(tx.TransactionBeginTime()).Seconds(),
+			TTLSeconds: -1,
+			Size:       cache.SizeOf(tx),
+		},
+		Code:         tx.Response().Code,
+		Header:       tx.Response().Header(),
+		BodyEncoding: "text",
+	}
+	if infos, err := entriesOf(name, store); err == nil {
+		for _, info := range infos {
+			if info.Key == key {
+				detail.AdminEntry = newAdminEntry(name, info, now)
+				break
+			}
+		}
+	}
+	body := tx.Response().Body.Bytes()
+	if utf8.Valid(body) {
+		detail.Body = string(body)
+	} else {
+		detail.Body = base64.StdEncoding.EncodeToString(body)
+		detail.BodyEncoding = "base64"
+	}
+	writeAdminJSON(res, http.StatusOK, detail)
+}
+
+func (ahh *AdminHTTPHandler) serveDelete(res http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if len(key) == 0 {
+		writeAdminError(res, http.StatusBadRequest, fmt.Errorf("key is required"))
+		return
+	}
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	deleted := 0
+	for _, store := range stores {
+		if store.Get(key, false, 0) != nil {
+			deleted++
+		}
+		store.Delete(key)
+	}
+	ahh.untag(stores, key)
+	writeAdminJSON(res, http.StatusOK, AdminPurgeResult{Deleted: deleted})
+}
+
+func (ahh *AdminHTTPHandler) servePurge(res http.ResponseWriter, req *http.Request) {
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	matcher, err := keyMatcher(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	if matcher == nil {
+		writeAdminError(res, http.StatusBadRequest, fmt.Errorf("prefix or match is required, use POST /cache/clear to delete everything"))
+		return
+	}
+	deleted := 0
+	for name, store := range stores {
+		infos, err := entriesOf(name, store)
+		if err != nil {
+			writeAdminError(res, http.StatusNotImplemented, err)
+			return
+		}
+		for _, info := range infos {
+			if matcher(info.Key) {
+				store.Delete(info.Key)
+				ahh.untag(stores, info.Key)
+				deleted++
+			}
+		}
+	}
+	writeAdminJSON(res, http.StatusOK, AdminPurgeResult{Deleted: deleted})
+}
+
+func (ahh *AdminHTTPHandler) serveClear(res http.ResponseWriter, req *http.Request) {
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	deleted := 0
+	for _, store := range stores {
+		deleted += store.Size()
+		store.Clear()
+	}
+	if len(stores) > 1 {
+		// no response is left to vary or to be tagged
+		ahh.Retter.Tags.Clear()
+		ahh.Retter.varyIndex.Clear()
+	}
+	writeAdminJSON(res, http.StatusOK, AdminPurgeResult{Deleted: deleted})
+}
+
+func (ahh *AdminHTTPHandler) servePurgeTags(res http.ResponseWriter, req *http.Request) {
+	tags := req.URL.Query()["tag"]
+	if len(tags) == 0 {
+		writeAdminError(res, http.StatusBadRequest, fmt.Errorf("tag is required"))
+		return
+	}
+	stores, err := ahh.stores(req)
+	if err != nil {
+		writeAdminError(res, http.StatusBadRequest, err)
+		return
+	}
+	var deleted int
+	if len(stores) > 1 {
+		deleted = ahh.Retter.PurgeTags(tags)
+	} else {
+		for _, store := range stores {
+			deleted = ahh.Retter.PurgeTags(tags, store)
+		}
+	}
+	writeAdminJSON(res, http.StatusOK, AdminPurgeResult{Deleted: deleted})
+}
+
+// untag removes a deleted key from the tag index, once it's deleted from all stores.
+func (ahh *AdminHTTPHandler) untag(stores map[string]cache.Store, key string) {
+	if len(stores) > 1 {
+		ahh.Retter.Tags.Untag(key)
+	}
+}
+
+func writeAdminJSON(res http.ResponseWriter, code int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		adminLog.Errorf("can not marshal admin response. got %s", err.Error())
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	res.Write(data)
+}
+
+func writeAdminError(res http.ResponseWriter, code int, err error) {
+	writeAdminJSON(res, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,156 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body of " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+	admin := NewAdminHTTPHandler(handler, "secret")
+
+	for _, path := range []string{"/products/1", "/products/2", "/products/3", "/users/1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost"+path, nil))
+	}
+
+	call := func(method, target, token string, body interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8090"+target, nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		admin.ServeHTTP(resp, req)
+		if body != nil {
+			if err := json.Unmarshal(resp.Body.Bytes(), body); err != nil {
+				t.Fatalf("%s %s returns invalid json %s. got %s", method, target, resp.Body.String(), err.Error())
+			}
+		}
+		return resp
+	}
+
+	if resp := call("GET", "/cache", "", nil); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expect 401 without token but %d", resp.Code)
+	}
+	if resp := call("GET", "/cache", "wrong", nil); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expect 401 with wrong token but %d", resp.Code)
+	}
+
+	var list []AdminEntry
+	call("GET", "/cache", "secret", &list)
+	if len(list) != 8 {
+		t.Fatalf("Expect 8 entries in both stores but %d", len(list))
+	}
+	call("GET", "/cache?store=cache&match=/products/*", "secret", &list)
+	if len(list) != 3 || list[0].Key != "/products/1" || list[0].Store != AdminStoreCache {
+		t.Fatalf("Expect 3 products in cache but %v", list)
+	}
+	if list[0].TTLSeconds <= 0 || list[0].TTLSeconds > 60 || list[0].Size <= 0 {
+		t.Errorf("Unexpected ttl or size %v", list[0])
+	}
+	call("GET", "/cache?store=last-known-success&prefix=/users", "secret", &list)
+	if len(list) != 1 || list[0].TTLSeconds <= 60 || list[0].TTLSeconds > 24*60*60 {
+		t.Errorf("Expect 1 user in last known success, expiring in 24 hours, but %v", list)
+	}
+
+	detail := &AdminEntryDetail{}
+	call("GET", "/cache/entry?key=/products/2", "secret", detail)
+	if detail.Code != http.StatusOK || detail.Body != "body of /products/2" || detail.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Unexpected entry %v", detail)
+	}
+	if resp := call("GET", "/cache/entry?key=/nothing", "secret", nil); resp.Code != http.StatusNotFound {
+		t.Errorf("Expect 404 for unknown key but %d", resp.Code)
+	}
+
+	result := &AdminPurgeResult{}
+	call("DELETE", "/cache/entry?key=/products/2", "secret", result)
+	if result.Deleted != 2 || handler.Cache.Get("/products/2", false, 0) != nil || handler.LastKnownSuccess.Get("/products/2", false, 0) != nil {
+		t.Errorf("Expect /products/2 deleted from both stores but %d", result.Deleted)
+	}
+	if resp := call("DELETE", "/cache", "secret", nil); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expect 400 to delete without prefix or match but %d", resp.Code)
+	}
+	call("DELETE", "/cache?prefix=/products/", "secret", result)
+	if result.Deleted != 4 || handler.Cache.Size() != 1 || handler.LastKnownSuccess.Size() != 1 {
+		t.Errorf("Expect 4 products deleted but %d", result.Deleted)
+	}
+	call("POST", "/cache/clear", "secret", result)
+	if result.Deleted != 2 || handler.Cache.Size() != 0 || handler.LastKnownSuccess.Size() != 0 {
+		t.Errorf("Expect both stores cleared but %d", result.Deleted)
+	}
+	if resp := call("PUT", "/cache/clear", "secret", nil); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expect 405 but %d", resp.Code)
+	}
+}
+
+func TestAdminClearVary(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Vary", "Accept-Language")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body in " + req.Header.Get("Accept-Language")))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheHTTPSemantics] = "true"
+	defer func() {
+		Config[CacheHTTPSemantics] = "false"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+	admin := NewAdminHTTPHandler(handler, "secret")
+
+	req := httptest.NewRequest("GET", "http://localhost/products/1", nil)
+	req.Header.Set("Accept-Language", "id")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if handler.varyIndex.Size() != 1 {
+		t.Fatalf("Expect the vary headers of the response remembered but %d", handler.varyIndex.Size())
+	}
+
+	clear := func(target string) {
+		req := httptest.NewRequest("POST", "http://localhost:8090"+target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		admin.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	clear("/cache/clear?store=cache")
+	if handler.varyIndex.Size() != 1 {
+		t.Errorf("Expect the vary headers kept for the last known success but %d", handler.varyIndex.Size())
+	}
+	clear("/cache/clear")
+	if handler.varyIndex.Size() != 0 {
+		t.Errorf("Expect the vary headers cleared with both stores but %d", handler.varyIndex.Size())
+	}
+}
@@ -0,0 +1,240 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sony/gobreaker"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// BalanceRoundRobin distribute calls to the instances in turn.
+	BalanceRoundRobin = "round-robin"
+
+	// BalanceLeastOutstanding distribute calls to the instance with the least in-flight calls.
+	BalanceLeastOutstanding = "least-outstanding"
+
+	// BalanceConsistentHash distribute calls by the hash of the request key, so the same key goes to the same instance.
+	BalanceConsistentHash = "consistent-hash"
+
+	// virtualNodes is the number of points of each instance in the consistent hash ring.
+	virtualNodes = 100
+)
+
+var (
+	// ErrNoInstance is returned when every instance of an upstream is ejected by its breaker or marked down.
+	ErrNoInstance = errors.New("no backend instance is available")
+)
+
+// InstanceBreakerPolicy is how the breaker of each backend instance ejects a failing instance.
+type InstanceBreakerPolicy struct {
+	// ConsecutiveFail ejects the instance once it fails this many times in a row.
+	ConsecutiveFail uint32
+
+	// OpenTimeout is how long an ejected instance is left alone before it's tried again.
+	OpenTimeout time.Duration
+}
+
+// NewInstanceBreakerPolicy creates the InstanceBreakerPolicy from the configuration.
+func NewInstanceBreakerPolicy() InstanceBreakerPolicy {
+	return InstanceBreakerPolicy{
+		ConsecutiveFail: uint32(Config.GetInt(InstanceConsecutiveFail)),
+		OpenTimeout:     Config.GetDuration(InstanceOpenTimeout),
+	}
+}
+
+// NewInstance creates a backend Instance with its own breaker.
+func NewInstance(baseURL string, policy InstanceBreakerPolicy) *Instance {
+	baseURL = strings.TrimSuffix(strings.TrimSpace(baseURL), "/")
+	return &Instance{
+		BaseURL: baseURL,
+		Breaker: NewCircuitBreaker(baseURL, BreakerPolicy{
+			MaxRequests: 1,
+			Timeout:     policy.OpenTimeout,
+			// the breaker trips once the consecutive failures exceed ConsecutiveFail, the instance once they reach it
+			ConsecutiveFail: int(policy.ConsecutiveFail) - 1,
+			// the instance is ejected by its consecutive failures only, never by its failure rate
+			MinRequests: math.MaxUint32,
+		}),
+	}
+}
+
+// Instance is one of the base URLs of an upstream.
+type Instance struct {
+	BaseURL string
+
+	// Breaker eject the instance while it keeps failing.
+	Breaker Breaker
+
+	outstanding int64
+	health      instanceHealth
+}
+
+// Available check whether the instance is neither ejected by its breaker nor marked down by the health checker.
+func (in *Instance) Available() bool {
+	return in.Breaker.State() != gobreaker.StateOpen && in.Healthy()
+}
+
+// Outstanding return the number of in-flight calls to the instance.
+func (in *Instance) Outstanding() int64 {
+	return atomic.LoadInt64(&in.outstanding)
+}
+
+// Execute call the instance through its breaker, recording the response into the recorder.
+// The failure classifier tells which responses are failures, nil counts the 5xx responses.
+// If the breaker refuses the call, the recorder gets 503 Service Unavailable.
+func (in *Instance) Execute(timeout time.Duration, failure *FailureClassifier, recorder *httptest.ResponseRecorder, req *http.Request) error {
+	atomic.AddInt64(&in.outstanding, 1)
+	defer atomic.AddInt64(&in.outstanding, -1)
+
+	from := in.Breaker.State()
+	_, err := in.Breaker.Execute(func() (interface{}, error) {
+		Execute(timeout, in.BaseURL, recorder, req)
+		// a cancelled call, such as the loser of a hedge, is neither the instance's failure nor its success.
+		if req.Context().Err() == context.Canceled {
+			return nil, errNotCounted
+		}
+		return nil, failure.Classify(recorder)
+	})
+	if to := in.Breaker.State(); to != from {
+		breakerLog.Infof("backend instance %s changed state from %s to %s", in.BaseURL, from.String(), to.String())
+	}
+	switch err {
+	case errNotCounted:
+		return nil
+	case gobreaker.ErrOpenState, gobreaker.ErrTooManyRequests:
+		recorder.WriteHeader(http.StatusServiceUnavailable)
+		recorder.Write([]byte(err.Error()))
+	}
+	return err
+}
+
+// Balancer pick the instance to call for each request.
+type Balancer interface {
+	// Pick an available instance for the request key, nil if every instance is ejected.
+	Pick(key string) *Instance
+}
+
+// NewBalancer creates the Balancer of the policy over the instances.
+func NewBalancer(policy string, instances []*Instance) (Balancer, error) {
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("balancer requires at least one instance")
+	}
+	switch strings.ToLower(policy) {
+	case BalanceRoundRobin, "":
+		return &roundRobinBalancer{instances: instances}, nil
+	case BalanceLeastOutstanding:
+		return &leastOutstandingBalancer{instances: instances}, nil
+	case BalanceConsistentHash:
+		return newConsistentHashBalancer(instances), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer \"%s\"", policy)
+	}
+}
+
+type roundRobinBalancer struct {
+	instances []*Instance
+	next      uint64
+}
+
+func (rr *roundRobinBalancer) Pick(key string) *Instance {
+	start := atomic.AddUint64(&rr.next, 1) - 1
+	for i := 0; i < len(rr.instances); i++ {
+		instance := rr.instances[(start+uint64(i))%uint64(len(rr.instances))]
+		if instance.Available() {
+			return instance
+		}
+	}
+	return nil
+}
+
+type leastOutstandingBalancer struct {
+	instances []*Instance
+	next      uint64
+}
+
+func (lo *leastOutstandingBalancer) Pick(key string) *Instance {
+	// start from a different instance each time, so ties are spread evenly
+	start := atomic.AddUint64(&lo.next, 1) - 1
+	var picked *Instance
+	for i := 0; i < len(lo.instances); i++ {
+		instance := lo.instances[(start+uint64(i))%uint64(len(lo.instances))]
+		if instance.Available() && (picked == nil || instance.Outstanding() < picked.Outstanding()) {
+			picked = instance
+		}
+	}
+	return picked
+}
+
+type ringPoint struct {
+	hash     uint32
+	instance *Instance
+}
+
+type consistentHashBalancer struct {
+	ring []ringPoint
+}
+
+func newConsistentHashBalancer(instances []*Instance) *consistentHashBalancer {
+	ring := make([]ringPoint, 0, len(instances)*virtualNodes)
+	for _, instance := range instances {
+		for v := 0; v < virtualNodes; v++ {
+			ring = append(ring, ringPoint{
+				hash:     hashOf(fmt.Sprintf("%s#%d", instance.BaseURL, v)),
+				instance: instance,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &consistentHashBalancer{ring: ring}
+}
+
+// Pick the instance owning the key on the ring. If it's ejected, the next available instance on the ring
+// takes over, so only the keys of the ejected instance move.
+func (ch *consistentHashBalancer) Pick(key string) *Instance {
+	hash := hashOf(key)
+	start := sort.Search(len(ch.ring), func(i int) bool {
+		return ch.ring[i].hash >= hash
+	})
+	for i := 0; i < len(ch.ring); i++ {
+		point := ch.ring[(start+i)%len(ch.ring)]
+		if point.instance.Available() {
+			return point.instance
+		}
+	}
+	return nil
+}
+
+func hashOf(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,194 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInstances(n int) []*Instance {
+	instances := make([]*Instance, n)
+	for i := range instances {
+		instances[i] = NewInstance(fmt.Sprintf("http://instance-%d", i), InstanceBreakerPolicy{ConsecutiveFail: 1})
+	}
+	return instances
+}
+
+func eject(instance *Instance) {
+	instance.Breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("failing")
+	})
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	instances := newTestInstances(3)
+	balancer, err := NewBalancer(BalanceRoundRobin, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picks := make(map[*Instance]int)
+	for i := 0; i < 30; i++ {
+		picks[balancer.Pick("/key")]++
+	}
+	for _, instance := range instances {
+		if picks[instance] != 10 {
+			t.Errorf("Expect %s picked 10 times but %d", instance.BaseURL, picks[instance])
+		}
+	}
+
+	eject(instances[1])
+	for i := 0; i < 30; i++ {
+		if balancer.Pick("/key") == instances[1] {
+			t.Fatalf("Expect ejected instance not picked")
+		}
+	}
+	eject(instances[0])
+	eject(instances[2])
+	if picked := balancer.Pick("/key"); picked != nil {
+		t.Errorf("Expect no instance when all are ejected but %s", picked.BaseURL)
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	instances := newTestInstances(3)
+	balancer, err := NewBalancer(BalanceLeastOutstanding, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances[0].outstanding = 5
+	instances[1].outstanding = 1
+	instances[2].outstanding = 3
+	if picked := balancer.Pick("/key"); picked != instances[1] {
+		t.Errorf("Expect the least outstanding instance but %s", picked.BaseURL)
+	}
+	eject(instances[1])
+	if picked := balancer.Pick("/key"); picked != instances[2] {
+		t.Errorf("Expect the least outstanding available instance but %s", picked.BaseURL)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	instances := newTestInstances(4)
+	balancer, err := NewBalancer(BalanceConsistentHash, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make(map[string]*Instance)
+	counts := make(map[*Instance]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("/products/%d", i)
+		owners[key] = balancer.Pick(key)
+		counts[owners[key]]++
+		if balancer.Pick(key) != owners[key] {
+			t.Fatalf("Expect the same key to go to the same instance")
+		}
+	}
+	for _, instance := range instances {
+		if counts[instance] < 100 {
+			t.Errorf("Expect keys spread across instances but %s owns %d", instance.BaseURL, counts[instance])
+		}
+	}
+
+	eject(instances[2])
+	for key, owner := range owners {
+		picked := balancer.Pick(key)
+		if picked == instances[2] || (owner != instances[2] && picked != owner) {
+			t.Fatalf("Expect only the keys of the ejected instance to move, %s moved from %s to %s", key, owner.BaseURL, picked.BaseURL)
+		}
+	}
+}
+
+func TestBadInstanceIsEjected(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	good := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("good " + req.URL.Path))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	Config[BackendURL] = strings.Join([]string{good.URL, bad.URL}, ",")
+	defer func() {
+		Config[BackendURL] = "http://localhost:8088"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	failures := 0
+	for i := 0; i < 30; i++ {
+		if resp := MakeCall("GET", fmt.Sprintf("/replica/%d", i), t, handler); resp.Code != http.StatusOK {
+			failures++
+		}
+	}
+	// the bad instance is ejected after 3 consecutive failures, the good one serves the rest
+	if failures != 3 {
+		t.Errorf("Expect 3 failures before the bad instance is ejected but %d", failures)
+	}
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	instances := health.Upstreams[0].Instances
+	if len(instances) != 2 || instances[0].Circuit != "CLOSED" || instances[1].Circuit != "OPEN" {
+		t.Errorf("Expect the bad instance to be ejected but %v", instances)
+	}
+}
+
+func TestCancelledCallNotCountedByInstance(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	bad := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	instance := NewInstance(bad.URL, InstanceBreakerPolicy{ConsecutiveFail: 2, OpenTimeout: time.Minute})
+	call := func(ctx context.Context) error {
+		req := httptest.NewRequest("GET", "http://localhost/orders", nil).WithContext(ctx)
+		return instance.Execute(time.Second, nil, httptest.NewRecorder(), req)
+	}
+
+	call(context.Background())
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := call(cancelled); err != nil {
+		t.Errorf("Expect no error for the cancelled call but %s", err.Error())
+	}
+	if counts := instance.Breaker.Counts(); counts.Requests != 1 || counts.ConsecutiveFailures != 1 {
+		t.Errorf("Expect the cancelled call not counted but %+v", counts)
+	}
+	call(context.Background())
+	if instance.Available() {
+		t.Errorf("Expect the instance ejected after 2 consecutive failures")
+	}
+}
@@ -19,9 +19,13 @@
 package main
 
 import (
+	"container/list"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/sony/gobreaker"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -30,44 +34,561 @@ var (
 		"module": "GoBreaker",
 		"file":   "Breaker.go",
 	})
+)
+
+const (
+	// BreakerLevelBackend is the level of the breaker of a whole upstream.
+	BreakerLevelBackend = "backend"
+
+	// BreakerLevelRoute is the level of the breaker of a route of an upstream.
+	BreakerLevelRoute = "route"
+
+	// BreakerLevelKey is the level of the breaker of a request key.
+	BreakerLevelKey = "key"
+
+	// BreakerWindowFixed counts the calls in fixed intervals, cleared at the end of each.
+	BreakerWindowFixed = "fixed"
+
+	// BreakerWindowCount counts the last calls.
+	BreakerWindowCount = "count"
+
+	// BreakerWindowTime counts the calls of the last interval, in buckets.
+	BreakerWindowTime = "time"
+)
+
+// Breaker is a circuit breaker protecting the calls to a backend.
+// A refused call fails with gobreaker.ErrOpenState or gobreaker.ErrTooManyRequests.
+type Breaker interface {
+	// Name of the breaker, such as the request key it protects.
+	Name() string
 
-	// PathBreakers is a map of string to gobreaker.CircuitBreaker.
-	// The string key is a full path + session key information.
-	// This makes each user's accessible path is circuit breaked.
-	PathBreakers = make(map[string]*gobreaker.CircuitBreaker)
+	// State of the breaker.
+	State() gobreaker.State
+
+	// Counts of the calls in the window of the breaker.
+	Counts() BreakerCounts
+
+	// OpenRemaining return how long the breaker stays open, zero if it's not open.
+	OpenRemaining() time.Duration
+
+	// Execute runs fn if the breaker accepts it, and counts its outcome.
+	// A call failing with errNotCounted is counted neither as a success nor as a failure.
+	Execute(fn func() (interface{}, error)) (interface{}, error)
+}
+
+// BreakerCounts is the calls counted by a breaker since it changed state, in its window.
+type BreakerCounts struct {
+	Requests            uint32
+	Failures            uint32
+	ConsecutiveFailures uint32
+	Slow                uint32
+}
+
+var (
+	// errNotCounted is the outcome of a call that says nothing about the backend, such as a call refused
+	// by a lower level of a BreakerChain or a call cancelled by its client. Breakers do not count it.
+	errNotCounted = errors.New("call not counted")
 )
 
-// GetBreakerSettingForRequest will create a grobreaker.Setting for each created CircuitBreaker.
-func GetBreakerSettingForRequest(req *http.Request) gobreaker.Settings {
-	key := getKey(req)
-	return gobreaker.Settings{
-		Name:        key,
-		MaxRequests: 1,
-		Interval:    10 * time.Second,
-		Timeout:     0,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			done := counts.TotalFailures + counts.TotalSuccesses
-			if done > 0 && counts.Requests > 4 {
-				breakerLog.Tracef("[%s] ready to trip. totalFail %d of %d", key, counts.TotalFailures, done)
-				failRate := float64(counts.TotalFailures) / float64(done)
-				return failRate > Config.GetFloat(FailureRate)
+// NewCircuitBreaker creates a CircuitBreaker named key with the thresholds and the window of the policy.
+func NewCircuitBreaker(key string, policy BreakerPolicy) *CircuitBreaker {
+	return newCircuitBreaker(key, policy, systemClock{})
+}
+
+// newCircuitBreaker creates a CircuitBreaker telling the time with clock, a fake clock in the tests.
+func newCircuitBreaker(key string, policy BreakerPolicy, clock Clock) *CircuitBreaker {
+	var window slidingWindow
+	switch policy.Window {
+	case BreakerWindowCount:
+		window = newCountWindow(policy.WindowSize)
+	case BreakerWindowTime:
+		window = newTimeWindow(policy.Interval, policy.WindowBuckets)
+	default:
+		window = &fixedWindow{interval: policy.Interval}
+	}
+	return &CircuitBreaker{
+		name:   key,
+		policy: policy,
+		clock:  clock,
+		window: window,
+		state:  gobreaker.StateClosed,
+	}
+}
+
+// CircuitBreaker is a Breaker behaving like gobreaker.CircuitBreaker, open once the calls in its window
+// reach the thresholds of its policy, half-open after the Timeout, and closed after MaxRequests successful calls.
+// Besides the failed calls, the calls slower than the SlowCallDuration of its policy may trip it.
+// Unlike gobreaker, a call may be counted neither as a success nor as a failure, see errNotCounted.
+type CircuitBreaker struct {
+	name   string
+	policy BreakerPolicy
+	clock  Clock
+	window slidingWindow
+
+	state               gobreaker.State
+	generation          uint64
+	openedAt            time.Time
+	consecutiveFailures uint32
+	halfOpenRequests    uint32
+	halfOpenSuccesses   uint32
+	mutex               sync.Mutex
+}
+
+// Name of the breaker.
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// State of the breaker, an open breaker turns half-open once its timeout elapsed.
+func (cb *CircuitBreaker) State() gobreaker.State {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.currentState(cb.clock.Now())
+}
+
+// Counts of the calls in the window of the breaker.
+func (cb *CircuitBreaker) Counts() BreakerCounts {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := cb.clock.Now()
+	cb.currentState(now)
+	requests, failures, slow := cb.window.totals(now)
+	return BreakerCounts{
+		Requests:            requests,
+		Failures:            failures,
+		ConsecutiveFailures: cb.consecutiveFailures,
+		Slow:                slow,
+	}
+}
+
+// OpenRemaining return how long the breaker stays open before turning half-open, zero if it's not open.
+func (cb *CircuitBreaker) OpenRemaining() time.Duration {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := cb.clock.Now()
+	if cb.currentState(now) != gobreaker.StateOpen {
+		return 0
+	}
+	return cb.openedAt.Add(cb.timeout()).Sub(now)
+}
+
+// Execute runs fn if the breaker accepts it, and counts its outcome and duration.
+// A slow call is a failure for the breaker, but its result is returned as it is.
+func (cb *CircuitBreaker) Execute(fn func() (interface{}, error)) (interface{}, error) {
+	generation, err := cb.beforeCall()
+	if err != nil {
+		return nil, err
+	}
+	start := cb.clock.Now()
+	result, err := fn()
+	if err == errNotCounted {
+		cb.release(generation)
+		return result, err
+	}
+	slow := cb.policy.SlowCallDuration > 0 && cb.clock.Now().Sub(start) >= cb.policy.SlowCallDuration
+	cb.afterCall(generation, err != nil, slow)
+	return result, err
+}
+
+// beforeCall refuses the call while open, or when the half-open breaker already has its trial calls.
+func (cb *CircuitBreaker) beforeCall() (uint64, error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.currentState(cb.clock.Now()) {
+	case gobreaker.StateOpen:
+		return cb.generation, gobreaker.ErrOpenState
+	case gobreaker.StateHalfOpen:
+		if cb.halfOpenRequests >= cb.maxRequests() {
+			return cb.generation, gobreaker.ErrTooManyRequests
+		}
+		cb.halfOpenRequests++
+	}
+	return cb.generation, nil
+}
+
+// release the trial call of the half-open breaker taken by a call that is not counted, so another call may try.
+func (cb *CircuitBreaker) release(generation uint64) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.currentState(cb.clock.Now()) == gobreaker.StateHalfOpen && generation == cb.generation && cb.halfOpenRequests > 0 {
+		cb.halfOpenRequests--
+	}
+}
+
+// afterCall counts the outcome of a call, ignoring calls started before the last change of state.
+func (cb *CircuitBreaker) afterCall(generation uint64, failed, slow bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := cb.clock.Now()
+	state := cb.currentState(now)
+	if generation != cb.generation {
+		return
+	}
+	if cb.window.record(now, failed, slow) {
+		// a fixed window starting over clears the consecutive failures too, as gobreaker does every interval
+		cb.consecutiveFailures = 0
+	}
+	if failed {
+		cb.consecutiveFailures++
+	} else {
+		cb.consecutiveFailures = 0
+	}
+	switch state {
+	case gobreaker.StateClosed:
+		if failed || slow {
+			requests, failures, slowCalls := cb.window.totals(now)
+			if cb.policy.tripped(cb.name, requests, failures, cb.consecutiveFailures, slowCalls) {
+				cb.setState(gobreaker.StateOpen, now)
+			}
+		}
+	case gobreaker.StateHalfOpen:
+		if failed || slow {
+			cb.setState(gobreaker.StateOpen, now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.maxRequests() {
+			cb.setState(gobreaker.StateClosed, now)
+		}
+	}
+}
+
+// currentState turns the open breaker half-open once its timeout elapsed.
+func (cb *CircuitBreaker) currentState(now time.Time) gobreaker.State {
+	if cb.state == gobreaker.StateOpen && now.Sub(cb.openedAt) >= cb.timeout() {
+		cb.setState(gobreaker.StateHalfOpen, now)
+	}
+	return cb.state
+}
+
+// setState change the state of the breaker, starting over with an empty window.
+func (cb *CircuitBreaker) setState(state gobreaker.State, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	breakerLog.Tracef("[%s] changed state from %s to %s", cb.name, getGoBreakerString(cb.state), getGoBreakerString(state))
+	cb.state = state
+	cb.generation++
+	cb.window.reset()
+	cb.consecutiveFailures = 0
+	cb.halfOpenRequests = 0
+	cb.halfOpenSuccesses = 0
+	if state == gobreaker.StateOpen {
+		cb.openedAt = now
+	}
+}
+
+// maxRequests is the number of trial calls of the half-open breaker, at least one as with gobreaker.
+func (cb *CircuitBreaker) maxRequests() uint32 {
+	if cb.policy.MaxRequests == 0 {
+		return 1
+	}
+	return cb.policy.MaxRequests
+}
+
+// timeout is how long the breaker stays open, 60 seconds if not set as with gobreaker.
+func (cb *CircuitBreaker) timeout() time.Duration {
+	if cb.policy.Timeout <= 0 {
+		return 60 * time.Second
+	}
+	return cb.policy.Timeout
+}
+
+// tripped check the outcomes of the recent calls against the thresholds of the policy.
+func (policy BreakerPolicy) tripped(key string, requests, failures, consecutiveFailures, slow uint32) bool {
+	if policy.SlowCallDuration > 0 && policy.SlowCallRate > 0 && requests > 0 && requests >= policy.SlowCallMinRequests {
+		slowRate := float64(slow) / float64(requests)
+		if slowRate >= policy.SlowCallRate {
+			breakerLog.Tracef("[%s] ready to trip. slow %d of %d", key, slow, requests)
+			return true
+		}
+	}
+	if requests > 0 && requests >= policy.MinRequests {
+		breakerLog.Tracef("[%s] ready to trip. totalFail %d of %d", key, failures, requests)
+		failRate := float64(failures) / float64(requests)
+		return failRate > policy.FailureRate
+	}
+	return int(consecutiveFailures) > policy.ConsecutiveFail
+}
+
+// NewAggregateBreakerPolicy creates the policy of a breaker counting many keys, such as the breaker of a route
+// or of a whole upstream. It trips only on the failure rate of at least minRequests requests,
+// so a few failing keys do not open it.
+func NewAggregateBreakerPolicy(failureRate float64, minRequests int) BreakerPolicy {
+	return BreakerPolicy{
+		MaxRequests:     1,
+		Interval:        10 * time.Second,
+		Timeout:         10 * time.Second,
+		FailureRate:     failureRate,
+		ConsecutiveFail: minRequests,
+		MinRequests:     uint32(minRequests),
+
+		SlowCallDuration:    Config.GetDuration(SlowCallDuration),
+		SlowCallRate:        Config.GetFloat(SlowCallRate),
+		SlowCallMinRequests: uint32(minRequests),
+
+		Window:        Config.GetString(BreakerWindow),
+		WindowSize:    Config.GetInt(BreakerWindowSize),
+		WindowBuckets: Config.GetInt(BreakerWindowBuckets),
+	}
+}
+
+// BreakerChain is the circuit breakers protecting a request, from the breaker of its upstream down to
+// the breaker of its key. A call goes through when none of them refuses it, and its outcome is counted by each of them.
+type BreakerChain struct {
+	Levels   []string
+	Breakers []Breaker
+	Policies []BreakerPolicy
+}
+
+// Add a breaker with its policy at the level below the ones already in the chain.
+func (bc *BreakerChain) Add(level string, breaker Breaker, policy BreakerPolicy) *BreakerChain {
+	bc.Levels = append(bc.Levels, level)
+	bc.Breakers = append(bc.Breakers, breaker)
+	bc.Policies = append(bc.Policies, policy)
+	return bc
+}
+
+// State return the state of the chain, OPEN if any breaker is open, HALF-OPEN if any is half-open, otherwise CLOSED.
+func (bc *BreakerChain) State() gobreaker.State {
+	state, _ := bc.worst()
+	return state
+}
+
+// OpenRemaining return how long until every open breaker of the chain turned half-open,
+// zero if none is open.
+func (bc *BreakerChain) OpenRemaining() time.Duration {
+	var longest time.Duration
+	for _, breaker := range bc.Breakers {
+		if remaining := breaker.OpenRemaining(); remaining > longest {
+			longest = remaining
+		}
+	}
+	return longest
+}
+
+// Circuit return the state of the chain as reported in the X-Circuit header, with the level of the breaker
+// that is not closed, such as "OPEN; level=backend".
+func (bc *BreakerChain) Circuit() string {
+	state, level := bc.worst()
+	if state == gobreaker.StateClosed {
+		return getGoBreakerString(state)
+	}
+	return fmt.Sprintf("%s; level=%s", getGoBreakerString(state), level)
+}
+
+// worst return the most severe state of the chain and the highest level in that state.
+func (bc *BreakerChain) worst() (gobreaker.State, string) {
+	state, level := gobreaker.StateClosed, ""
+	for i, breaker := range bc.Breakers {
+		switch breaker.State() {
+		case gobreaker.StateOpen:
+			return gobreaker.StateOpen, bc.Levels[i]
+		case gobreaker.StateHalfOpen:
+			if state == gobreaker.StateClosed {
+				state, level = gobreaker.StateHalfOpen, bc.Levels[i]
 			}
-			return int(counts.ConsecutiveFailures) > Config.GetInt(ConsecutiveFail)
-		},
-		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-			breakerLog.Tracef("[%s] changed state from %s to %s", key, from.String(), to.String())
-		},
+		}
 	}
+	return state, level
+}
+
+// Execute call fn through every breaker of the chain, the highest level first.
+// A call refused by a lower level never reached the backend, so the levels above count it neither as
+// a success nor as a failure, and it fails with the refusal of that level.
+func (bc *BreakerChain) Execute(fn func() (interface{}, error)) (interface{}, error) {
+	if bc.State() == gobreaker.StateOpen {
+		return nil, gobreaker.ErrOpenState
+	}
+	var refused error
+	call := fn
+	for i := len(bc.Breakers) - 1; i >= 0; i-- {
+		breaker, inner := bc.Breakers[i], call
+		call = func() (interface{}, error) {
+			val, err := breaker.Execute(inner)
+			if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+				refused = err
+				return val, errNotCounted
+			}
+			return val, err
+		}
+	}
+	val, err := call()
+	if refused != nil {
+		return val, refused
+	}
+	return val, err
+}
+
+// NewBreakerRegistry creates a new empty BreakerRegistry, holding at most maxSize breakers, zero is unlimited,
+// and evicting the CLOSED breakers not used for idleTimeout, zero never evicts idle breakers.
+func NewBreakerRegistry(maxSize int, idleTimeout time.Duration) *BreakerRegistry {
+	return &BreakerRegistry{
+		MaxSize:     maxSize,
+		IdleTimeout: idleTimeout,
+		breakers:    make(map[string]*list.Element),
+		recent:      list.New(),
+	}
+}
+
+// BreakerRegistry keep a gobreaker.CircuitBreaker for each request key.
+// The key is a full path + session key information.
+// This makes each user's accessible path is circuit breaked. It's safe for concurrent use.
+// As every query string and every user may have a key, the registry is bounded: CLOSED breakers
+// are evicted once idle, or when the registry is full, the least recently used first.
+// A CLOSED breaker holds nothing worth keeping, so evicting it is the same as resetting it.
+type BreakerRegistry struct {
+	// MaxSize is the maximum number of breakers, zero is unlimited.
+	MaxSize int
+
+	// IdleTimeout is how long a CLOSED breaker is kept without being used, zero is forever.
+	IdleTimeout time.Duration
+
+	breakers  map[string]*list.Element
+	recent    *list.List
+	lastSweep time.Time
+	evictions uint64
+	overflows uint64
+	mutex     sync.Mutex
+}
+
+type registeredBreaker struct {
+	key      string
+	breaker  Breaker
+	lastUsed time.Time
+}
+
+// Get return the CircuitBreaker of the request, creating it with the policy if the request's key has none.
+// If the registry is full of breakers that are not CLOSED, the returned breaker is not kept.
+func (br *BreakerRegistry) Get(req *http.Request, policy BreakerPolicy) Breaker {
+	return br.GetNamed(getKey(req), policy)
 }
 
-// GetBreakerForRequest returns a CircuitBreaker to be use for circuit breaking
-// each particular request.
-func GetBreakerForRequest(req *http.Request) *gobreaker.CircuitBreaker {
-	key := getKey(req)
-	if b, ok := PathBreakers[key]; ok {
-		return b
+// GetNamed return the CircuitBreaker of the key, creating it with the policy if there's none.
+// If the registry is full of breakers that are not CLOSED, the returned breaker is not kept.
+func (br *BreakerRegistry) GetNamed(key string, policy BreakerPolicy) Breaker {
+	now := time.Now()
+
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	if element, ok := br.breakers[key]; ok {
+		element.Value.(*registeredBreaker).lastUsed = now
+		br.recent.MoveToFront(element)
+		return element.Value.(*registeredBreaker).breaker
 	}
-	newBreaker := gobreaker.NewCircuitBreaker(GetBreakerSettingForRequest(req))
-	PathBreakers[key] = newBreaker
+	br.evictIdle(now)
+	newBreaker := NewCircuitBreaker(key, policy)
+	if br.MaxSize > 0 && br.recent.Len() >= br.MaxSize && !br.evictOldest() {
+		br.overflows++
+		breakerLog.Warnf("breaker registry is full, breaker of %s is not kept", key)
+		return newBreaker
+	}
+	br.breakers[key] = br.recent.PushFront(&registeredBreaker{
+		key:      key,
+		breaker:  newBreaker,
+		lastUsed: now,
+	})
 	return newBreaker
 }
+
+// evictIdle remove the CLOSED breakers idle for longer than IdleTimeout. To keep Get cheap, it only looks
+// for idle breakers once in half of the IdleTimeout. The mutex must be held.
+func (br *BreakerRegistry) evictIdle(now time.Time) {
+	if br.IdleTimeout <= 0 || now.Sub(br.lastSweep) < br.IdleTimeout/2 {
+		return
+	}
+	br.lastSweep = now
+	for element := br.recent.Back(); element != nil; {
+		entry := element.Value.(*registeredBreaker)
+		if now.Sub(entry.lastUsed) < br.IdleTimeout {
+			return
+		}
+		previous := element.Prev()
+		if entry.breaker.State() == gobreaker.StateClosed {
+			br.remove(element)
+		}
+		element = previous
+	}
+}
+
+// evictOldest remove the least recently used CLOSED breaker. Return false if every breaker is
+// OPEN or HALF-OPEN. The mutex must be held.
+func (br *BreakerRegistry) evictOldest() bool {
+	for element := br.recent.Back(); element != nil; element = element.Prev() {
+		if element.Value.(*registeredBreaker).breaker.State() == gobreaker.StateClosed {
+			br.remove(element)
+			return true
+		}
+	}
+	return false
+}
+
+// remove the breaker of the element. The mutex must be held.
+func (br *BreakerRegistry) remove(element *list.Element) {
+	br.recent.Remove(element)
+	delete(br.breakers, element.Value.(*registeredBreaker).key)
+	br.evictions++
+}
+
+// Size return the number of breakers in the registry.
+func (br *BreakerRegistry) Size() int {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	return br.recent.Len()
+}
+
+// Circuits return the state of each breaker in the registry, by its key.
+func (br *BreakerRegistry) Circuits() map[string]string {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	circuits := make(map[string]string, br.recent.Len())
+	for element := br.recent.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*registeredBreaker)
+		circuits[entry.key] = getGoBreakerString(entry.breaker.State())
+	}
+	return circuits
+}
+
+// Evictions return the number of breakers evicted from the registry.
+func (br *BreakerRegistry) Evictions() uint64 {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	return br.evictions
+}
+
+// Overflows return the number of breakers not kept because the registry was full.
+func (br *BreakerRegistry) Overflows() uint64 {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+
+	return br.overflows
+}
+
+// GetBreakerForRequest returns the breakers to be use for circuit breaking each particular request:
+// the breaker of the request's upstream, of its route in that upstream and, if the route has per key breakers,
+// of the request's key. Requests that are not cached skip the route level and always have a per key breaker,
+// as the key includes their method.
+func (rhh *RetterHTTPHandler) GetBreakerForRequest(req *http.Request) *BreakerChain {
+	upstream := rhh.Upstreams.Match(req)
+	route := rhh.Routes.Match(req)
+	policy := route.BreakerPolicy(req.Method)
+	chain := (&BreakerChain{}).Add(BreakerLevelBackend, upstream.Breaker, upstream.BreakerPolicy)
+	if !route.Cacheable(req.Method) {
+		return chain.Add(BreakerLevelKey, upstream.Breakers.Get(req, policy), policy)
+	}
+	chain.Add(BreakerLevelRoute, upstream.RouteBreakers.GetNamed(route.Name, route.RouteBreaker), route.RouteBreaker)
+	if route.PerKeyBreaker {
+		chain.Add(BreakerLevelKey, upstream.Breakers.Get(req, policy), policy)
+	}
+	return chain
+}
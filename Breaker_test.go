@@ -0,0 +1,405 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sony/gobreaker"
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteBreaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var calls, fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.WriteHeader(http.StatusCreated)
+		res.Write([]byte(req.Method + " done"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[WriteConsecutiveFail] = "2"
+	Config[WriteOpenTimeout] = "30 seconds"
+	Config[InstanceConsecutiveFail] = "100"
+	defer func() {
+		Config[InstanceConsecutiveFail] = "3"
+		Config[WriteConsecutiveFail] = "3"
+		Config[WriteOpenTimeout] = "10 seconds"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	post := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("POST", "http://localhost/orders", strings.NewReader("order")))
+		return resp
+	}
+	if resp := post(); resp.Code != http.StatusCreated || resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Fatalf("Expect POST forwarded but %d, circuit %s", resp.Code, resp.Header().Get("X-Circuit"))
+	}
+
+	// the backend errors are given back as they are, until the breaker opens.
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 3; i++ {
+		if resp := post(); resp.Code != http.StatusInternalServerError {
+			t.Errorf("Expect backend error #%d but %d", i, resp.Code)
+		}
+	}
+	before := atomic.LoadInt32(&calls)
+	resp := post()
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("X-Circuit") != "OPEN; level=key" || resp.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expect fast fail with Retry-After but %d, circuit %s, Retry-After %s", resp.Code, resp.Header().Get("X-Circuit"), resp.Header().Get("Retry-After"))
+	}
+	if atomic.LoadInt32(&calls) != before {
+		t.Errorf("Expect no backend call while the circuit is open")
+	}
+	if handler.Cache.Size() != 0 || handler.LastKnownSuccess.Size() != 0 {
+		t.Errorf("Expect POST responses never stored")
+	}
+
+	// GET of the same path has its own breaker.
+	atomic.StoreInt32(&fail, 0)
+	if resp := MakeCall("GET", "/orders", t, handler); resp.Code != http.StatusCreated || resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect GET unaffected by the POST breaker but %d, circuit %s", resp.Code, resp.Header().Get("X-Circuit"))
+	}
+}
+
+func TestCancelledWriteNotCounted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	received := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		received <- true
+		<-req.Context().Done()
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[WriteConsecutiveFail] = "0"
+	defer func() {
+		Config[WriteConsecutiveFail] = "3"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "http://localhost/orders", strings.NewReader("order")).WithContext(ctx)
+	go func() {
+		<-received
+		cancel()
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	chain := handler.GetBreakerForRequest(req)
+	for i, breaker := range chain.Breakers {
+		if breaker.State() != gobreaker.StateClosed || breaker.Counts() != (BreakerCounts{}) {
+			t.Errorf("Expect the cancelled POST not counted by the %s breaker but %s %+v", chain.Levels[i], getGoBreakerString(breaker.State()), breaker.Counts())
+		}
+	}
+}
+
+func TestBreakerRegistry(t *testing.T) {
+	policy := BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 0, Timeout: time.Minute}
+	get := func(registry *BreakerRegistry, path string) Breaker {
+		return registry.Get(httptest.NewRequest("GET", path, nil), policy)
+	}
+	trip := func(breaker Breaker) {
+		breaker.Execute(func() (interface{}, error) {
+			return nil, errors.New("failing")
+		})
+	}
+
+	registry := NewBreakerRegistry(3, 0)
+	a := get(registry, "/a")
+	get(registry, "/b")
+	get(registry, "/c")
+	if get(registry, "/a") != a {
+		t.Errorf("Expect the same breaker for the same key")
+	}
+	get(registry, "/d")
+	if registry.Size() != 3 || registry.Evictions() != 1 || get(registry, "/a") != a {
+		t.Errorf("Expect the least recently used breaker evicted but size %d, %d evictions", registry.Size(), registry.Evictions())
+	}
+
+	// OPEN breakers are never evicted, new keys get a breaker that is not kept.
+	for _, path := range []string{"/a", "/c", "/d"} {
+		trip(get(registry, path))
+	}
+	if get(registry, "/e") == get(registry, "/e") || registry.Size() != 3 || registry.Overflows() != 2 {
+		t.Errorf("Expect breakers not kept when full of OPEN breakers but size %d, %d overflows", registry.Size(), registry.Overflows())
+	}
+	if get(registry, "/c").State() != gobreaker.StateOpen {
+		t.Errorf("Expect OPEN breaker kept")
+	}
+
+	// idle CLOSED breakers are evicted, idle OPEN breakers are kept.
+	registry = NewBreakerRegistry(0, 50*time.Millisecond)
+	get(registry, "/x")
+	trip(get(registry, "/y"))
+	time.Sleep(60 * time.Millisecond)
+	get(registry, "/z")
+	if registry.Size() != 2 || registry.Evictions() != 1 || get(registry, "/y").State() != gobreaker.StateOpen {
+		t.Errorf("Expect only the idle CLOSED breaker evicted but size %d, %d evictions", registry.Size(), registry.Evictions())
+	}
+}
+
+func TestBreakerChainOpenRemaining(t *testing.T) {
+	clock := newFakeClock()
+	policy := BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 0, MinRequests: 100, Timeout: 5 * time.Second}
+	backend := newCircuitBreaker("backend", policy, clock)
+	key := newCircuitBreaker("key", BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 0, MinRequests: 100, Timeout: time.Minute}, clock)
+	chain := (&BreakerChain{}).Add(BreakerLevelBackend, backend, policy).Add(BreakerLevelKey, key, policy)
+
+	for _, breaker := range []Breaker{key, backend} {
+		breaker.Execute(func() (interface{}, error) {
+			return nil, errors.New("failing")
+		})
+	}
+	clock.Advance(2 * time.Second)
+	if remaining := chain.OpenRemaining(); remaining != 58*time.Second {
+		t.Errorf("Expect the chain open until the key breaker turns half-open in 58s but %s", remaining)
+	}
+}
+
+func TestBreakerChain(t *testing.T) {
+	clock := newFakeClock()
+	policy := BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 1, MinRequests: 100, Timeout: time.Minute}
+	backend := newCircuitBreaker("backend", policy, clock)
+	key := newCircuitBreaker("key", BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 0, MinRequests: 100, Timeout: 5 * time.Second}, clock)
+	chain := (&BreakerChain{}).Add(BreakerLevelBackend, backend, policy).Add(BreakerLevelKey, key, policy)
+
+	failing := func() (interface{}, error) {
+		return nil, errors.New("failing")
+	}
+	if _, err := chain.Execute(failing); err == nil || chain.Circuit() != "OPEN; level=key" {
+		t.Fatalf("Expect the key breaker to open but %s", chain.Circuit())
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := chain.Execute(failing); err != gobreaker.ErrOpenState {
+			t.Errorf("Expect call refused but %v", err)
+		}
+	}
+	if counts := backend.Counts(); backend.State() != gobreaker.StateClosed || counts != (BreakerCounts{Requests: 1, Failures: 1, ConsecutiveFailures: 1}) {
+		t.Errorf("Expect calls refused by the key breaker not counted by the backend breaker but %s %+v", backend.State(), counts)
+	}
+	clock.Advance(2 * time.Second)
+	if remaining := chain.OpenRemaining(); remaining != 3*time.Second {
+		t.Errorf("Expect the key breaker half-open in 3s but %s", remaining)
+	}
+
+	// calls refused by the half-open key breaker while its trial call runs are not counted either.
+	clock.Advance(3 * time.Second)
+	if remaining := chain.OpenRemaining(); remaining != 0 {
+		t.Errorf("Expect nothing left open but %s", remaining)
+	}
+	inTrial := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		chain.Execute(func() (interface{}, error) {
+			inTrial <- true
+			<-done
+			return "ok", nil
+		})
+		close(inTrial)
+	}()
+	<-inTrial
+	for i := 0; i < 5; i++ {
+		if _, err := chain.Execute(succeed); err != gobreaker.ErrTooManyRequests {
+			t.Errorf("Expect call refused during the trial but %v", err)
+		}
+	}
+	if counts := backend.Counts(); counts != (BreakerCounts{Requests: 1, Failures: 1, ConsecutiveFailures: 1}) {
+		t.Errorf("Expect calls refused during the trial not counted by the backend breaker but %+v", counts)
+	}
+	close(done)
+	<-inTrial
+	if counts := backend.Counts(); key.State() != gobreaker.StateClosed || counts != (BreakerCounts{Requests: 2, Failures: 1}) {
+		t.Errorf("Expect only the trial call counted by the backend breaker but %s %+v", getGoBreakerString(key.State()), counts)
+	}
+}
+
+func TestNotCountedCall(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newCircuitBreaker("not-counted", BreakerPolicy{MaxRequests: 1, ConsecutiveFail: 0, MinRequests: 100, Timeout: 5 * time.Second}, clock)
+	notCounted := func() (interface{}, error) {
+		return "gone", errNotCounted
+	}
+	if val, err := breaker.Execute(notCounted); val != "gone" || err != errNotCounted || breaker.Counts() != (BreakerCounts{}) {
+		t.Errorf("Expect call not counted but %v - %v, %+v", val, err, breaker.Counts())
+	}
+	breaker.Execute(fail)
+	clock.Advance(5 * time.Second)
+
+	// the trial call of the half-open breaker is given back to the next call
+	breaker.Execute(notCounted)
+	if _, err := breaker.Execute(succeed); err != nil || breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect next trial call to close the breaker but %v, %s", err, getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestBreakerHierarchy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[RouteMinRequests] = "4"
+	Config[BackendMinRequests] = "8"
+	Config[InstanceConsecutiveFail] = "100"
+	Config[RoutePolicies] = `[{"name": "api", "prefix": "/api", "per-key-breaker": false}]`
+	defer func() {
+		Config[RouteMinRequests] = "20"
+		Config[BackendMinRequests] = "50"
+		Config[InstanceConsecutiveFail] = "3"
+		Config[RoutePolicies] = ""
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	// every URL of the route fails once, the route breaker opens for all of them.
+	for i := 1; i <= 4; i++ {
+		MakeCall("GET", fmt.Sprintf("/api/%d", i), t, handler)
+	}
+	before := atomic.LoadInt32(&calls)
+	if resp := MakeCall("GET", "/api/5", t, handler); resp.Header().Get("X-Circuit") != "OPEN; level=route" {
+		t.Errorf("Expect the route breaker open but %s", resp.Header().Get("X-Circuit"))
+	}
+	if resp := MakeCall("GET", "/other/1", t, handler); resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect other routes unaffected but %s", resp.Header().Get("X-Circuit"))
+	}
+	if atomic.LoadInt32(&calls) != before+1 {
+		t.Errorf("Expect no backend call for the open route")
+	}
+
+	// failures across the routes open the backend breaker.
+	for i := 2; i <= 4; i++ {
+		MakeCall("GET", fmt.Sprintf("/other/%d", i), t, handler)
+	}
+	if resp := MakeCall("GET", "/other/5", t, handler); resp.Header().Get("X-Circuit") != "OPEN; level=backend" {
+		t.Errorf("Expect the backend breaker open but %s", resp.Header().Get("X-Circuit"))
+	}
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	if upstream := health.Upstreams[0]; upstream.Circuit != "OPEN" || upstream.RouteCircuits["api"] != "OPEN" || upstream.BreakerCount != 5 {
+		t.Errorf("Unexpected upstream circuits %v", upstream)
+	}
+}
+
+func TestSlowCallBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker("slow", BreakerPolicy{
+		MaxRequests:         1,
+		ConsecutiveFail:     100,
+		MinRequests:         100,
+		SlowCallDuration:    20 * time.Millisecond,
+		SlowCallRate:        0.5,
+		SlowCallMinRequests: 4,
+	})
+	call := func(sleep time.Duration) {
+		val, err := breaker.Execute(func() (interface{}, error) {
+			time.Sleep(sleep)
+			return "answer", nil
+		})
+		if val != "answer" || err != nil {
+			t.Errorf("Expect the result of a slow call given back but %v, %v", val, err)
+		}
+	}
+	call(0)
+	call(0)
+	call(30 * time.Millisecond)
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect breaker closed before the minimum calls")
+	}
+	call(30 * time.Millisecond)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Errorf("Expect breaker open once half of the calls are slow but %s", breaker.State())
+	}
+
+	// a zero rate disables slow call tripping rather than tripping on any call
+	breaker = NewCircuitBreaker("slow", BreakerPolicy{
+		MaxRequests:         1,
+		ConsecutiveFail:     100,
+		MinRequests:         100,
+		SlowCallDuration:    20 * time.Millisecond,
+		SlowCallMinRequests: 1,
+	})
+	call(0)
+	call(30 * time.Millisecond)
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect breaker closed with a zero slow call rate but %s", breaker.State())
+	}
+}
+
+func TestSlowRoute(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/slow") {
+			time.Sleep(80 * time.Millisecond)
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[RoutePolicies] = `[{"prefix": "/slow", "breaker": {"slow-call-duration": "50 milliseconds", "slow-call-min-requests": 2}}]`
+	defer func() {
+		Config[RoutePolicies] = ""
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp := MakeCall("GET", "/slow/report", t, handler); resp.Code != http.StatusOK || resp.Header().Get("X-Retter") != "backend" {
+			t.Errorf("Expect slow response given back but %d from %s", resp.Code, resp.Header().Get("X-Retter"))
+		}
+		MakeCall("GET", "/fast/report", t, handler)
+	}
+	if resp := MakeCall("GET", "/slow/report", t, handler); resp.Header().Get("X-Circuit") != "OPEN; level=key" || resp.Header().Get("X-Retter") != "cache" {
+		t.Errorf("Expect slow route served from cache with its circuit open but %s from %s", resp.Header().Get("X-Circuit"), resp.Header().Get("X-Retter"))
+	}
+	if resp := MakeCall("GET", "/fast/report", t, handler); resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect other routes unaffected but %s", resp.Header().Get("X-Circuit"))
+	}
+}
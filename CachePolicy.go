@@ -0,0 +1,247 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/hyperjumptech/retter/cache"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheDirectives is the parsed Cache-Control header, directive name in lower case to its value.
+// Directives without value, such as no-store, have an empty value.
+type CacheDirectives map[string]string
+
+// ParseCacheControl parse all Cache-Control headers into CacheDirectives
+func ParseCacheControl(header http.Header) CacheDirectives {
+	directives := make(CacheDirectives)
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if len(part) == 0 {
+				continue
+			}
+			name, value := part, ""
+			if eq := strings.Index(part, "="); eq >= 0 {
+				name, value = part[:eq], strings.Trim(strings.TrimSpace(part[eq+1:]), "\"")
+			}
+			directives[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return directives
+}
+
+// Has check if the directive is present
+func (cd CacheDirectives) Has(name string) bool {
+	_, ok := cd[name]
+	return ok
+}
+
+// Seconds return the value of a delta-seconds directive such as max-age.
+func (cd CacheDirectives) Seconds(name string) (time.Duration, bool) {
+	value, ok := cd[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// CachePolicy decide whether a backend response can be stored and for how long.
+type CachePolicy struct {
+	// DefaultTTL is used when HTTP caching semantic is not honored or when the backend gives no freshness information.
+	DefaultTTL time.Duration
+
+	// HonorHTTPSemantics when true, freshness is derived from Cache-Control, Expires and Age headers as RFC 9111
+	// describes for a shared cache. Otherwise every response is cached for DefaultTTL.
+	HonorHTTPSemantics bool
+
+	// StaleWhileRevalidate is how long a stale response may be served while being refreshed in the background,
+	// unless the backend specify its own stale-while-revalidate directive. Only cache first serves stale responses
+	// while refreshing them, otherwise the backend is always called first.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long a stale response may be served when the backend fails,
+	// unless the backend specify its own stale-if-error directive.
+	StaleIfError time.Duration
+}
+
+// NewCachePolicy create a CachePolicy from the configuration
+func NewCachePolicy() *CachePolicy {
+	return &CachePolicy{
+		DefaultTTL:           time.Duration(Config.GetInt(CacheTTL)) * time.Second,
+		HonorHTTPSemantics:   Config.GetBoolean(CacheHTTPSemantics),
+		StaleWhileRevalidate: time.Duration(Config.GetInt(CacheStaleWhileRevalidate)) * time.Second,
+		StaleIfError:         time.Duration(Config.GetInt(CacheStaleIfError)) * time.Second,
+	}
+}
+
+// Storable check whether the response may be stored at all, either in the cache or as last known success.
+func (cp *CachePolicy) Storable(req *http.Request, header http.Header) bool {
+	if !cp.HonorHTTPSemantics {
+		return true
+	}
+	directives := ParseCacheControl(header)
+	if directives.Has("no-store") || directives.Has("private") {
+		return false
+	}
+	if header.Get("Vary") == "*" {
+		return false
+	}
+	// a shared cache must not store response to an authorized request, unless explicitly allowed.
+	if len(req.Header.Get("Authorization")) > 0 &&
+		!directives.Has("public") && !directives.Has("s-maxage") && !directives.Has("must-revalidate") {
+		return false
+	}
+	return true
+}
+
+// TTL return how long the response is fresh, zero if it must not be served from cache without contacting the backend.
+func (cp *CachePolicy) TTL(header http.Header, now time.Time) time.Duration {
+	if !cp.HonorHTTPSemantics {
+		return cp.DefaultTTL
+	}
+	directives := ParseCacheControl(header)
+	if directives.Has("no-cache") {
+		return 0
+	}
+
+	var age time.Duration
+	if ageSecs, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && ageSecs > 0 {
+		age = time.Duration(ageSecs) * time.Second
+	}
+
+	lifetime, ok := directives.Seconds("s-maxage")
+	if !ok {
+		lifetime, ok = directives.Seconds("max-age")
+	}
+	if !ok {
+		if expiresHeader := header.Get("Expires"); len(expiresHeader) > 0 {
+			expires, err := http.ParseTime(expiresHeader)
+			if err != nil {
+				// invalid Expires means already expired
+				return 0
+			}
+			date := now
+			if dateHeader, err := http.ParseTime(header.Get("Date")); err == nil {
+				date = dateHeader
+			}
+			lifetime, ok = expires.Sub(date), true
+		}
+	}
+	if !ok {
+		return cp.DefaultTTL
+	}
+	if lifetime <= age {
+		return 0
+	}
+	return lifetime - age
+}
+
+// Freshness return the TTL and stale windows of a response. The backend's stale-while-revalidate and stale-if-error
+// directives (RFC 5861) take precedence over the configured ones. When HTTP semantics is honored,
+// must-revalidate and proxy-revalidate forbid serving the response once it is stale.
+// The backend's own stale-if-error and must-revalidate also bound serving the response as last known success.
+func (cp *CachePolicy) Freshness(header http.Header, now time.Time) Freshness {
+	directives := ParseCacheControl(header)
+	fresh := Freshness{
+		TTL:                  cp.TTL(header, now),
+		StaleWhileRevalidate: cp.StaleWhileRevalidate,
+		StaleIfError:         cp.StaleIfError,
+	}
+	if swr, ok := directives.Seconds("stale-while-revalidate"); ok {
+		fresh.StaleWhileRevalidate = swr
+	}
+	if sie, ok := directives.Seconds("stale-if-error"); ok {
+		fresh.StaleIfError = sie
+		fresh.StrictStaleIfError = true
+	}
+	if cp.HonorHTTPSemantics && (directives.Has("must-revalidate") || directives.Has("proxy-revalidate")) {
+		fresh.StaleWhileRevalidate = 0
+		fresh.StaleIfError = 0
+		fresh.StrictStaleIfError = true
+	}
+	return fresh
+}
+
+// VaryHeaders return the canonical and sorted list of request header names the response varies by.
+func VaryHeaders(header http.Header) []string {
+	names := make([]string, 0)
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if len(name) > 0 && name != "*" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyKey append the request's values of the vary headers into a base cache key.
+func varyKey(key string, req *http.Request, varyHeaders []string) string {
+	if len(varyHeaders) == 0 {
+		return key
+	}
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range varyHeaders {
+		sb.WriteString(fmt.Sprintf("|%s=%s", name, strings.Join(req.Header.Values(name), ",")))
+	}
+	return sb.String()
+}
+
+// getCacheKey return the key to store or look up the request's response in the cache.
+// It is the getKey of the request in the namespace of its upstream, plus the request header values
+// the cached response varies by.
+func (rhh *RetterHTTPHandler) getCacheKey(req *http.Request) string {
+	key := rhh.Upstreams.Match(req).Namespace(getKey(req))
+	if val := rhh.varyIndex.Get(key, false, 0); val != nil {
+		return varyKey(key, req, val.([]string))
+	}
+	return key
+}
+
+// rememberVary record the headers the response of a request varies by, and return the cache key for the response.
+func (rhh *RetterHTTPHandler) rememberVary(req *http.Request, header http.Header) string {
+	key := rhh.Upstreams.Match(req).Namespace(getKey(req))
+	if !rhh.Routes.Match(req).CachePolicy.HonorHTTPSemantics {
+		return key
+	}
+	varyHeaders := VaryHeaders(header)
+	if len(varyHeaders) == 0 {
+		rhh.varyIndex.Delete(key)
+		return key
+	}
+	rhh.varyIndex.Set(key, varyHeaders, 0)
+	return varyKey(key, req, varyHeaders)
+}
+
+// newVaryIndex creates the store of vary headers of each key, bounded the same as the cache.
+func newVaryIndex() cache.Store {
+	return cache.NewBoundedMemoryStore(cache.EvictLRU, Config.GetInt(CacheMaxEntries), 0)
+}
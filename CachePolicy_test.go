@@ -0,0 +1,126 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachePolicyTTL(t *testing.T) {
+	now := time.Now()
+	policy := &CachePolicy{DefaultTTL: time.Minute, HonorHTTPSemantics: true}
+	testData := []struct {
+		header   http.Header
+		storable bool
+		ttl      time.Duration
+	}{
+		{http.Header{}, true, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=30"}}, true, 30 * time.Second},
+		{http.Header{"Cache-Control": {"public, max-age=30, s-maxage=10"}}, true, 10 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=30"}, "Age": {"20"}}, true, 10 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=30"}, "Age": {"40"}}, true, 0},
+		{http.Header{"Cache-Control": {"no-cache"}}, true, 0},
+		{http.Header{"Cache-Control": {"no-store"}}, false, time.Minute},
+		{http.Header{"Cache-Control": {"private, max-age=30"}}, false, 30 * time.Second},
+		{http.Header{"Vary": {"*"}}, false, time.Minute},
+		{http.Header{"Expires": {now.Add(45 * time.Second).UTC().Format(http.TimeFormat)}, "Date": {now.UTC().Format(http.TimeFormat)}}, true, 45 * time.Second},
+		{http.Header{"Expires": {"0"}}, true, 0},
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for i, td := range testData {
+		if storable := policy.Storable(req, td.header); storable != td.storable {
+			t.Errorf("#%d expect storable %v but %v", i, td.storable, storable)
+		}
+		if ttl := policy.TTL(td.header, now); ttl != td.ttl {
+			t.Errorf("#%d expect ttl %s but %s", i, td.ttl, ttl)
+		}
+	}
+
+	authorized := httptest.NewRequest("GET", "/", nil)
+	authorized.Header.Set("Authorization", "Bearer secret")
+	if policy.Storable(authorized, http.Header{}) {
+		t.Errorf("Expect response to authorized request not to be storable")
+	}
+	if !policy.Storable(authorized, http.Header{"Cache-Control": {"public"}}) {
+		t.Errorf("Expect public response to authorized request to be storable")
+	}
+
+	policy.HonorHTTPSemantics = false
+	if !policy.Storable(req, http.Header{"Cache-Control": {"no-store"}}) || policy.TTL(http.Header{"Cache-Control": {"max-age=1"}}, now) != time.Minute {
+		t.Errorf("Expect headers to be ignored when HTTP semantics is not honored")
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Cache-Control", "max-age=60")
+		res.Header().Set("Vary", "Accept-Language")
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprintf(res, "hello in %s", req.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheHTTPSemantics] = "true"
+	defer func() {
+		Config[CacheHTTPSemantics] = "false"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	call := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/vary/path", nil)
+		req.Header.Set("Accept-Language", lang)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	for _, lang := range []string{"en", "id"} {
+		if resp := call(lang); resp.Body.String() != "hello in "+lang {
+			t.Fatalf("Unexpected body %s", resp.Body.String())
+		}
+	}
+	if handler.Cache.Size() != 2 {
+		t.Errorf("Expect a cache entry for each language but %d", handler.Cache.Size())
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	for _, lang := range []string{"en", "id"} {
+		resp := call(lang)
+		if resp.Header().Get("X-Retter") != "cache" || resp.Body.String() != "hello in "+lang {
+			t.Errorf("Expect cached %s variant but %s - %s", lang, resp.Header().Get("X-Retter"), resp.Body.String())
+		}
+	}
+	if resp := call("fr"); resp.Header().Get("X-Retter") != "no-cache" {
+		t.Errorf("Expect no cached variant for fr but %s", resp.Header().Get("X-Retter"))
+	}
+}
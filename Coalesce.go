@@ -0,0 +1,114 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrCoalesceTimeout is returned to a caller that waited too long for an in-flight call to finish.
+	ErrCoalesceTimeout = fmt.Errorf("timeout waiting for in-flight backend call")
+)
+
+// Coalescer collapse concurrent calls with the same key into a single in-flight call.
+// Callers that arrive while a call for their key is in-flight wait for it and share its result.
+type Coalescer struct {
+	// MaxWait is the longest time a caller waits for an in-flight call, zero means wait until it finish.
+	MaxWait time.Duration
+
+	mutex     sync.Mutex
+	calls     map[string]*coalescedCall
+	coalesced uint64
+	timedOut  uint64
+}
+
+type coalescedCall struct {
+	done chan bool
+	tx   *DefaultHTTPTransaction
+	err  error
+}
+
+// NewCoalescer creates a new Coalescer
+func NewCoalescer(maxWait time.Duration) *Coalescer {
+	return &Coalescer{
+		MaxWait: maxWait,
+		calls:   make(map[string]*coalescedCall),
+	}
+}
+
+// Do call fn, unless a call for the same key is in-flight, in which case it waits for that call
+// and return its result. shared is true if the result comes from another caller's call.
+// A successful result is only shared when shareable accepts it, otherwise the waiting caller calls fn itself.
+func (c *Coalescer) Do(key string, fn func() (*DefaultHTTPTransaction, error),
+	shareable func(tx *DefaultHTTPTransaction) bool) (tx *DefaultHTTPTransaction, shared bool, err error) {
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.coalesced, 1)
+		tx, shared, err = c.wait(call)
+		if err == nil && shareable != nil && !shareable(tx) {
+			atomic.AddUint64(&c.coalesced, ^uint64(0))
+			tx, err = fn()
+			return tx, false, err
+		}
+		return tx, shared, err
+	}
+	call := &coalescedCall{done: make(chan bool)}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+	call.tx, call.err = fn()
+	return call.tx, false, call.err
+}
+
+func (c *Coalescer) wait(call *coalescedCall) (*DefaultHTTPTransaction, bool, error) {
+	if c.MaxWait <= 0 {
+		<-call.done
+		return call.tx, true, call.err
+	}
+	timer := time.NewTimer(c.MaxWait)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.tx, true, call.err
+	case <-timer.C:
+		atomic.AddUint64(&c.timedOut, 1)
+		return nil, true, ErrCoalesceTimeout
+	}
+}
+
+// CoalescedCount return the number of calls that shared the result of an in-flight call.
+func (c *Coalescer) CoalescedCount() uint64 {
+	return atomic.LoadUint64(&c.coalesced)
+}
+
+// TimedOutCount return the number of calls that gave up waiting for an in-flight call.
+func (c *Coalescer) TimedOutCount() uint64 {
+	return atomic.LoadUint64(&c.timedOut)
+}
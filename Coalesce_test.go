@@ -0,0 +1,185 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var backendCalls int32
+	received := make(chan string, 2)
+	gates := map[string]chan bool{"/slow": make(chan bool), "/very/slow": make(chan bool)}
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&backendCalls, 1)
+		received <- req.URL.Path
+		<-gates[req.URL.Path]
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("shared response"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CoalesceEnabled] = "true"
+	defer func() {
+		Config[CoalesceEnabled] = "false"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	call := func(path string, results chan *httptest.ResponseRecorder, wg *sync.WaitGroup) {
+		defer wg.Done()
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost"+path, nil))
+		results <- resp
+	}
+
+	// the backend answers once every request joined the in-flight call
+	results := make(chan *httptest.ResponseRecorder, 50)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go call("/slow", results, wg)
+	}
+	<-received
+	for handler.Coalescer.CoalescedCount() < 49 {
+		runtime.Gosched()
+	}
+	close(gates["/slow"])
+	wg.Wait()
+	close(results)
+	for resp := range results {
+		if resp.Code != http.StatusOK || resp.Body.String() != "shared response" {
+			t.Fatalf("Unexpected response %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+	if atomic.LoadInt32(&backendCalls) != 1 {
+		t.Errorf("Expect 1 backend call but %d", atomic.LoadInt32(&backendCalls))
+	}
+	if handler.Coalescer.CoalescedCount() != 49 {
+		t.Errorf("Expect 49 coalesced requests but %d", handler.Coalescer.CoalescedCount())
+	}
+
+	// waiting longer than max wait gives up, the backend answers once the second request gave up
+	handler.Coalescer.MaxWait = 10 * time.Millisecond
+	results = make(chan *httptest.ResponseRecorder, 2)
+	wg.Add(1)
+	go call("/very/slow", results, wg)
+	<-received
+	waiter := &sync.WaitGroup{}
+	waiter.Add(1)
+	call("/very/slow", results, waiter)
+	close(gates["/very/slow"])
+	wg.Wait()
+	close(results)
+	codes := make(map[int]int)
+	for resp := range results {
+		codes[resp.Code]++
+	}
+	if codes[http.StatusOK] != 1 || codes[http.StatusGatewayTimeout] != 1 {
+		t.Errorf("Expect one success and one gateway timeout but %v", codes)
+	}
+	if handler.Coalescer.TimedOutCount() != 1 {
+		t.Errorf("Expect 1 timed out request but %d", handler.Coalescer.TimedOutCount())
+	}
+}
+
+func TestCoalescingPrivate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var backendCalls int32
+	received := make(chan string, 2)
+	gate := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&backendCalls, 1)
+		received <- req.URL.Path
+		<-gate
+		res.Header().Set("Cache-Control", "private")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("private response"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CoalesceEnabled] = "true"
+	Config[CacheHTTPSemantics] = "true"
+	defer func() {
+		Config[CoalesceEnabled] = "false"
+		Config[CacheHTTPSemantics] = "false"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	call := func(path, authorization string, wg *sync.WaitGroup) {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		if len(authorization) > 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("Unexpected response %d - %s", resp.Code, resp.Body.String())
+		}
+	}
+
+	// a waiter does not share a private response, it calls the backend once the in-flight call is done
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go call("/private", "", wg)
+	<-received
+	go call("/private", "", wg)
+	for handler.Coalescer.CoalescedCount() < 1 {
+		runtime.Gosched()
+	}
+	close(gate)
+	wg.Wait()
+	if atomic.LoadInt32(&backendCalls) != 2 {
+		t.Errorf("Expect 2 backend calls but %d", atomic.LoadInt32(&backendCalls))
+	}
+	if handler.Coalescer.CoalescedCount() != 0 {
+		t.Errorf("Expect no coalesced request but %d", handler.Coalescer.CoalescedCount())
+	}
+
+	// requests with credentials never wait for each other
+	gate = make(chan bool)
+	wg.Add(2)
+	go call("/authorized", "Bearer alice", wg)
+	go call("/authorized", "Bearer bob", wg)
+	<-received
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("Expect requests with credentials to call the backend without waiting for each other")
+	}
+	close(gate)
+	wg.Wait()
+	if atomic.LoadInt32(&backendCalls) != 4 {
+		t.Errorf("Expect 4 backend calls but %d", atomic.LoadInt32(&backendCalls))
+	}
+}
@@ -0,0 +1,112 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperjumptech/retter/test"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentRequests hammers a single handler from many goroutines. Run it with -race
+// to verify the handler's shared state is race free.
+func TestConcurrentRequests(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	test.StartDummyServer("127.0.0.1:34251", false)
+	defer test.StopDummyServer()
+	test.FailProbability(0.3)
+	defer test.FailProbability(0.0)
+	test.SetFastest(0, 5*time.Millisecond)
+	defer test.SetFastest(0, time.Second)
+
+	Config[BackendURL] = "http://127.0.0.1:34251"
+	Config[CacheFirst] = "true"
+	Config[CacheTTL] = "1"
+	Config[CacheStaleWhileRevalidate] = "5"
+	Config[CacheMaxEntries] = "20"
+	defer func() {
+		Config[CacheFirst] = "false"
+		Config[CacheTTL] = "60"
+		Config[CacheStaleWhileRevalidate] = "0"
+		Config[CacheMaxEntries] = "0"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+	admin := NewAdminHTTPHandler(handler, "secret")
+
+	const workers = 50
+	const requestsPerWorker = 60
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < requestsPerWorker; i++ {
+				var req *http.Request
+				switch i % 10 {
+				case 0:
+					req = httptest.NewRequest("POST", "http://localhost/concurrent/post", strings.NewReader("posted"))
+				case 1:
+					req = httptest.NewRequest("GET", "http://localhost/health", nil)
+				default:
+					req = httptest.NewRequest("GET", fmt.Sprintf("http://localhost/concurrent/%d", (w+i)%40), nil)
+				}
+				if i%3 == 0 {
+					req.Header.Set("Accept-Encoding", "gzip")
+				}
+				resp := httptest.NewRecorder()
+				handler.ServeHTTP(resp, req)
+				if resp.Code == 0 {
+					t.Errorf("No response for %s %s", req.Method, req.URL.Path)
+				}
+				if i%20 == 5 {
+					adminReq := httptest.NewRequest("DELETE", "http://localhost/cache?prefix=/concurrent/1", nil)
+					adminReq.Header.Set("Authorization", "Bearer secret")
+					admin.ServeHTTP(httptest.NewRecorder(), adminReq)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	handler.background.Wait()
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	expected := uint64(workers * requestsPerWorker * 9 / 10)
+	if health.TotalRequestServed != expected {
+		t.Errorf("Expect %d requests served but %d", expected, health.TotalRequestServed)
+	}
+	// 40 paths, plus the breaker of the POST requests
+	if health.BreakerCount != 41 || health.CacheCount > 20 {
+		t.Errorf("Expect 41 breakers and at most 20 cached but %d and %d", health.BreakerCount, health.CacheCount)
+	}
+	if health.SlowestResponseTimeMs < health.FastestResponseTimeMs {
+		t.Errorf("Slowest %d is faster than fastest %d", health.SlowestResponseTimeMs, health.FastestResponseTimeMs)
+	}
+}
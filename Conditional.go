@@ -0,0 +1,123 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var (
+	// headers that describe the body itself, a 304 response must not change them in the stored response.
+	bodyHeaders = map[string]bool{
+		"Content-Length":   true,
+		"Content-Encoding": true,
+		"Content-Type":     true,
+		"Content-Range":    true,
+	}
+)
+
+// etagMatch do a weak comparison of an entity tag against a list of entity tags, such as in If-None-Match header.
+func etagMatch(etag string, list string) bool {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified check whether the client's conditional request is satisfied by a response with the specified header,
+// so the client may be answered with 304 Not Modified. If-None-Match takes precedence over If-Modified-Since.
+func NotModified(req *http.Request, header http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		return etagMatch(header.Get("ETag"), inm)
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
+
+// ReturnNotModified write 304 Not Modified response using the recorded headers, without the body.
+// Headers already set in the writer take precedence over the recorded ones.
+func ReturnNotModified(recorder *httptest.ResponseRecorder, writer http.ResponseWriter) {
+	copyHeader(recorder.Header(), writer)
+	writer.Header().Del("Content-Length")
+	writer.WriteHeader(http.StatusNotModified)
+}
+
+// conditionalRequest creates the request to be sent to the backend. The client's own conditional headers
+// are removed so the backend gives a complete response that can be stored. If there's a stored response
+// with validators, they are sent so the backend may answer with 304 Not Modified instead.
+// The request is detached from the client's connection, as its response is shared and stored.
+func conditionalRequest(req *http.Request, stored HTTPTransaction) *http.Request {
+	backendReq := req.Clone(context.Background())
+	backendReq.Header.Del("If-None-Match")
+	backendReq.Header.Del("If-Modified-Since")
+	if stored == nil || stored.Response().Code != http.StatusOK {
+		return backendReq
+	}
+	if etag := stored.Response().Header().Get("ETag"); len(etag) > 0 {
+		backendReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stored.Response().Header().Get("Last-Modified"); len(lastModified) > 0 {
+		backendReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return backendReq
+}
+
+// revalidated creates a new recorder out of a stored response, updated with the headers of the backend's
+// 304 Not Modified response. The stored response is not modified.
+func revalidated(stored HTTPTransaction, notModified *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	for k, v := range stored.Response().Header() {
+		recorder.Header()[k] = append([]string(nil), v...)
+	}
+	for k, v := range notModified.Header() {
+		if !bodyHeaders[k] {
+			recorder.Header()[k] = append([]string(nil), v...)
+		}
+	}
+	if len(notModified.Header().Get("Date")) == 0 {
+		recorder.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	recorder.Header().Del("Age")
+	recorder.Header().Del("X-Retter")
+	recorder.Header().Del("X-Circuit")
+	recorder.WriteHeader(stored.Response().Code)
+	recorder.Write(stored.Response().Body.Bytes())
+	return recorder
+}
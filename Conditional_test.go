@@ -0,0 +1,126 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	now := time.Now().UTC()
+	header := http.Header{
+		"Etag":          {`W/"v1"`},
+		"Last-Modified": {now.Add(-time.Hour).Format(http.TimeFormat)},
+	}
+	testData := []struct {
+		method      string
+		inm         string
+		ims         string
+		notModified bool
+	}{
+		{"GET", `"v1"`, "", true},
+		{"GET", `"v0", W/"v1"`, "", true},
+		{"GET", "*", "", true},
+		{"GET", `"v2"`, now.Format(http.TimeFormat), false},
+		{"GET", "", now.Format(http.TimeFormat), true},
+		{"GET", "", now.Add(-2 * time.Hour).Format(http.TimeFormat), false},
+		{"HEAD", `"v1"`, "", true},
+		{"POST", `"v1"`, "", false},
+		{"GET", "", "", false},
+	}
+	for i, td := range testData {
+		req := httptest.NewRequest(td.method, "/", nil)
+		if len(td.inm) > 0 {
+			req.Header.Set("If-None-Match", td.inm)
+		}
+		if len(td.ims) > 0 {
+			req.Header.Set("If-Modified-Since", td.ims)
+		}
+		if NotModified(req, header) != td.notModified {
+			t.Errorf("#%d expect not modified %v", i, td.notModified)
+		}
+	}
+}
+
+func TestConditionalRevalidation(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var fullResponses, notModifiedResponses int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModifiedResponses, 1)
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fullResponses, 1)
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("the full body"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	call := func(inm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/conditional", nil)
+		if len(inm) > 0 {
+			req.Header.Set("If-None-Match", inm)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := call("")
+	if resp.Code != http.StatusOK || resp.Body.String() != "the full body" || resp.Header().Get("X-Retter") != "backend" {
+		t.Fatalf("Unexpected response %d - %s - %s", resp.Code, resp.Body.String(), resp.Header().Get("X-Retter"))
+	}
+	cached := handler.Cache.Get(getKey(httptest.NewRequest("GET", "/conditional", nil)), false, 0).(HTTPTransaction)
+
+	resp = call(`"v1"`)
+	if resp.Code != http.StatusNotModified || resp.Body.Len() != 0 || resp.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("Expect 304 to the client but %d - %s", resp.Code, resp.Body.String())
+	}
+
+	resp = call("")
+	if resp.Code != http.StatusOK || resp.Body.String() != "the full body" || resp.Header().Get("X-Retter") != "revalidated" {
+		t.Fatalf("Unexpected response %d - %s - %s", resp.Code, resp.Body.String(), resp.Header().Get("X-Retter"))
+	}
+	if atomic.LoadInt32(&fullResponses) != 1 || atomic.LoadInt32(&notModifiedResponses) != 2 {
+		t.Errorf("Expect backend to send the body once and 304 twice, but %d and %d", fullResponses, notModifiedResponses)
+	}
+	refreshed := handler.Cache.Get(getKey(httptest.NewRequest("GET", "/conditional", nil)), false, 0).(HTTPTransaction)
+	if !refreshed.TransactionBeginTime().After(cached.TransactionBeginTime()) {
+		t.Errorf("Expect 304 from backend to refresh the cached response")
+	}
+
+	// client's conditional request is answered from the cache when the backend is down
+	backend.Close()
+	resp = call(`"v1"`)
+	if resp.Code != http.StatusNotModified || resp.Header().Get("X-Retter") != "cache" {
+		t.Errorf("Expect 304 from the cache but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+}
@@ -19,29 +19,150 @@
 package main
 
 import (
+	"github.com/hyperjumptech/jiffy"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	// CacheTTL is key config for number of TTL in second
 	CacheTTL = "cache.ttl"
 
+	// CacheHTTPSemantics is key config for specifying whether to honor the backend's Cache-Control, Expires and Vary headers
+	CacheHTTPSemantics = "cache.http.semantics"
+
+	// CacheFirst is key config for specifying whether fresh cached responses are served without calling the backend
+	CacheFirst = "cache.first"
+
+	// CacheStaleWhileRevalidate is key config for number of seconds a stale cached response may be served while it is refreshed,
+	// only with CacheFirst
+	CacheStaleWhileRevalidate = "cache.stale.while.revalidate"
+
+	// CacheStaleIfError is key config for number of seconds a stale cached response may be served when the backend fails
+	CacheStaleIfError = "cache.stale.if.error"
+
+	// CacheStore is key config for the name of cache storage backend to use
+	CacheStore = "cache.store"
+
+	// CacheEvictPolicy is key config for the policy to evict cache entries when the cache is full, lru or lfu
+	CacheEvictPolicy = "cache.evict.policy"
+
+	// CacheMaxEntries is key config for the maximum number of cached entries, 0 means unlimited
+	CacheMaxEntries = "cache.max.entries"
+
+	// CacheMaxBytes is key config for the maximum total bytes of cached response bodies, 0 means unlimited
+	CacheMaxBytes = "cache.max.bytes"
+
+	// CacheDiskDir is key config for the directory where the disk cache store keeps its files
+	CacheDiskDir = "cache.disk.dir"
+
+	// CacheDiskCompact is key config for how often the disk cache store removes expired files
+	CacheDiskCompact = "cache.disk.compact"
+
+	// CacheTagHeaders is key config for the comma separated response headers carrying the tags to purge responses by
+	CacheTagHeaders = "cache.tag.headers"
+
 	// CacheDetectQuery is key config for specifying whether to include session detection or not
 	CacheDetectQuery = "cache.detect.query"
 
 	// CacheDetectSession is key config for specifying whether to include session detection or not
 	CacheDetectSession = "cache.detect.session"
 
-	// BackendURL is key config for the base URL to call to backend
+	// LastKnownMaxEntries is key config for the maximum number of last known success responses, 0 means unlimited
+	LastKnownMaxEntries = "lastknown.max.entries"
+
+	// LastKnownMaxBytes is key config for the maximum total bytes of last known success responses, 0 means unlimited
+	LastKnownMaxBytes = "lastknown.max.bytes"
+
+	// LastKnownMaxAge is key config for the oldest last known success response that may be served, 0 means no limit
+	LastKnownMaxAge = "lastknown.max.age"
+
+	// LastKnownEvictPolicy is key config for the policy to evict last known success responses when full, lru or lfu
+	LastKnownEvictPolicy = "lastknown.evict.policy"
+
+	// CoalesceEnabled is key config for specifying whether concurrent identical requests share a single backend call
+	CoalesceEnabled = "coalesce.enabled"
+
+	// CoalesceMaxWait is key config for the longest time a request waits for an identical in-flight backend call
+	CoalesceMaxWait = "coalesce.max.wait"
+
+	// BackendURL is key config for the base URL to call to backend, comma separated for several instances
 	BackendURL = "backend.baseurl"
 
+	// Upstreams is key config for the named backends requests are routed to by host and path, a JSON array or the path of a JSON file
+	Upstreams = "upstreams"
+
+	// BackendBalancer is key config for how calls are distributed across the backend.baseurl instances,
+	// round-robin, least-outstanding or consistent-hash
+	BackendBalancer = "backend.balancer"
+
+	// InstanceConsecutiveFail is key config for the number of consecutive failures to eject a backend instance
+	InstanceConsecutiveFail = "backend.instance.consecutive.fail"
+
+	// InstanceOpenTimeout is key config for how long an ejected backend instance is left alone before it's tried again
+	InstanceOpenTimeout = "backend.instance.open.timeout"
+
+	// HealthCheckPath is key config for the path to call on each backend instance to check its health, empty disables it
+	HealthCheckPath = "health.check.path"
+
+	// HealthCheckInterval is key config for the time between two health checks of a backend instance
+	HealthCheckInterval = "health.check.interval"
+
+	// HealthCheckTimeout is key config for the longest time to wait for a health check response
+	HealthCheckTimeout = "health.check.timeout"
+
+	// HealthCheckRise is key config for the number of consecutive successful health checks to mark a backend instance up
+	HealthCheckRise = "health.check.rise"
+
+	// HealthCheckFall is key config for the number of consecutive failed health checks to mark a backend instance down
+	HealthCheckFall = "health.check.fall"
+
+	// RetryMax is key config for the number of times a failed backend call is retried, 0 disables retries
+	RetryMax = "retry.max"
+
+	// RetryMethods is key config for the comma separated request methods to retry, they must be idempotent
+	RetryMethods = "retry.methods"
+
+	// RetryStatusCodes is key config for the comma separated backend response codes to retry, 502 and 504 are always retried
+	RetryStatusCodes = "retry.status.codes"
+
+	// RetryBackoff is key config for the delay before the first retry, doubled for each following retry
+	RetryBackoff = "retry.backoff"
+
+	// RetryBackoffMax is key config for the longest delay before a retry, including the backend's Retry-After
+	RetryBackoffMax = "retry.backoff.max"
+
+	// RetryBudgetRatio is key config for the number of retries allowed for each request, 0.1 means 10% extra load
+	RetryBudgetRatio = "retry.budget.ratio"
+
+	// RetryBudgetMin is key config for the number of retries allowed every 10 seconds regardless of the ratio
+	RetryBudgetMin = "retry.budget.min"
+
+	// HedgeDelay is key config for how long to wait for a backend call before firing a second identical one, 0 disables hedging
+	HedgeDelay = "hedge.delay"
+
+	// HedgePercentile is key config for the percentile of recent backend latencies to wait before hedging, 0 uses hedge.delay
+	HedgePercentile = "hedge.percentile"
+
+	// BackendTimeout is key config for the longest time to wait for a backend response
+	BackendTimeout = "backend.timeout"
+
+	// RoutePolicies is key config for the route policies, a JSON array or the path of a JSON file
+	RoutePolicies = "route.policies"
+
 	// ServerListen is key config for the server listening setting (bind host and port)
 	ServerListen = "server.listen"
 
+	// AdminListen is key config for the admin API listening setting (bind host and port), empty disables the admin API
+	AdminListen = "admin.listen"
+
+	// AdminToken is key config for the bearer token required to call the admin API
+	AdminToken = "admin.token"
+
 	// FailureRate is key config for the failure rate detection in the CircuitBreaker.
 	// If the request to backend has reached this failure rate, circuit will open.
 	// The fail rate will reset every 10 second
@@ -49,6 +170,66 @@ const (
 
 	// ConsecutiveFail is key config for the number of consecutive backend http call fails.
 	ConsecutiveFail = "breaker.consecutive.fail"
+
+	// SlowCallDuration is key config for the duration from which a backend call is slow, 0 disables slow call tripping
+	SlowCallDuration = "breaker.slow.call.duration"
+
+	// SlowCallRate is key config for the rate of slow backend calls to open the circuit
+	SlowCallRate = "breaker.slow.call.rate"
+
+	// SlowCallMinRequests is key config for the number of backend calls before the slow call rate is considered
+	SlowCallMinRequests = "breaker.slow.call.min.requests"
+
+	// FailureStatusCodes is key config for the comma separated backend response codes counted as failures besides 5xx
+	FailureStatusCodes = "breaker.failure.status.codes"
+
+	// FailureIgnoreCodes is key config for the comma separated 5xx backend response codes not counted as failures
+	FailureIgnoreCodes = "breaker.failure.ignore.codes"
+
+	// FailureHeaders is key config for the comma separated response headers, as Name or Name:regex, marking a failure
+	FailureHeaders = "breaker.failure.headers"
+
+	// FailureBodyPattern is key config for the regex of the response bodies counted as failures
+	FailureBodyPattern = "breaker.failure.body.pattern"
+
+	// BreakerWindow is key config for how the circuit breakers count the calls, fixed, count or time
+	BreakerWindow = "breaker.window"
+
+	// BreakerWindowSize is key config for the number of last calls counted by the count window
+	BreakerWindowSize = "breaker.window.size"
+
+	// BreakerWindowBuckets is key config for the number of buckets of the time window
+	BreakerWindowBuckets = "breaker.window.buckets"
+
+	// BreakerPerKey is key config for specifying whether each request key has its own circuit breaker, below the route's
+	BreakerPerKey = "breaker.per.key"
+
+	// RouteFailureRate is key config for the failure rate of the requests of a route to open the circuit of the whole route
+	RouteFailureRate = "breaker.route.fail.rate"
+
+	// RouteMinRequests is key config for the number of requests of a route before its failure rate is considered
+	RouteMinRequests = "breaker.route.min.requests"
+
+	// BackendFailureRate is key config for the failure rate of the requests to a backend to open the circuit of the whole backend
+	BackendFailureRate = "breaker.backend.fail.rate"
+
+	// BackendMinRequests is key config for the number of requests to a backend before its failure rate is considered
+	BackendMinRequests = "breaker.backend.min.requests"
+
+	// BreakerMaxCount is key config for the maximum number of circuit breakers of each upstream, 0 means unlimited
+	BreakerMaxCount = "breaker.max.count"
+
+	// BreakerIdleTimeout is key config for how long an unused CLOSED circuit breaker is kept, 0 means forever
+	BreakerIdleTimeout = "breaker.idle.timeout"
+
+	// WriteFailureRate is key config for the failure rate to open the circuit of requests that are not cached, such as POST.
+	WriteFailureRate = "breaker.write.fail.rate"
+
+	// WriteConsecutiveFail is key config for the number of consecutive fails to open the circuit of requests that are not cached.
+	WriteConsecutiveFail = "breaker.write.consecutive.fail"
+
+	// WriteOpenTimeout is key config for how long the circuit of requests that are not cached stays open.
+	WriteOpenTimeout = "breaker.write.open.timeout"
 )
 
 var (
@@ -62,14 +243,73 @@ var (
 		CacheTTL:                   "60",    // time to live in seconds
 		CacheDetectSession:         "false", // always account session cookie in the cache
 		CacheDetectQuery:           "true",  // always account request URL query in the cache
+		CacheHTTPSemantics:         "false",
+		CacheFirst:                 "false",
+		CacheStaleWhileRevalidate:  "0",
+		CacheStaleIfError:          "0",
+		CacheStore:                 "memory",
+		CacheEvictPolicy:           "lru",
+		CacheMaxEntries:            "0",
+		CacheMaxBytes:              "0",
+		CacheDiskDir:               "retter-cache",
+		CacheDiskCompact:           "1 minute",
+		CacheTagHeaders:            "Surrogate-Key,Cache-Tag",
+		LastKnownMaxEntries:        "10000",
+		LastKnownMaxBytes:          "0",
+		LastKnownMaxAge:            "24 hours",
+		LastKnownEvictPolicy:       "lru",
+		CoalesceEnabled:            "false",
+		CoalesceMaxWait:            "15 seconds",
 		BackendURL:                 "http://localhost:8088",
+		Upstreams:                  "",
+		BackendBalancer:            "round-robin",
+		InstanceConsecutiveFail:    "3",
+		InstanceOpenTimeout:        "10 seconds",
+		HealthCheckPath:            "",
+		HealthCheckInterval:        "10 seconds",
+		HealthCheckTimeout:         "2 seconds",
+		HealthCheckRise:            "2",
+		HealthCheckFall:            "3",
+		RetryMax:                   "0",
+		RetryMethods:               "GET,HEAD",
+		RetryStatusCodes:           "502,503,504",
+		RetryBackoff:               "100 milliseconds",
+		RetryBackoffMax:            "2 seconds",
+		RetryBudgetRatio:           "0.1",
+		RetryBudgetMin:             "3",
+		HedgeDelay:                 "0 seconds",
+		HedgePercentile:            "0",
+		BackendTimeout:             "15 seconds",
+		RoutePolicies:              "",
 		ServerListen:               ":8089",
+		AdminListen:                "",
+		AdminToken:                 "",
 		"server.timeout.write":     "15 seconds",
 		"server.timeout.read":      "15 seconds",
 		"server.timeout.idle":      "60 seconds",
 		"server.timeout.graceshut": "15 seconds",
 		FailureRate:                "0.66",
 		ConsecutiveFail:            "5",
+		SlowCallDuration:           "0 seconds",
+		SlowCallRate:               "0.5",
+		SlowCallMinRequests:        "5",
+		FailureStatusCodes:         "",
+		FailureIgnoreCodes:         "",
+		FailureHeaders:             "",
+		FailureBodyPattern:         "",
+		BreakerWindow:              "fixed",
+		BreakerWindowSize:          "100",
+		BreakerWindowBuckets:       "10",
+		BreakerPerKey:              "true",
+		RouteFailureRate:           "0.5",
+		RouteMinRequests:           "20",
+		BackendFailureRate:         "0.5",
+		BackendMinRequests:         "50",
+		BreakerMaxCount:            "10000",
+		BreakerIdleTimeout:         "10 minutes",
+		WriteFailureRate:           "0.5",
+		WriteConsecutiveFail:       "3",
+		WriteOpenTimeout:           "10 seconds",
 	}
 )
 
@@ -149,3 +389,18 @@ func (c Configuration) GetBoolean(key string) bool {
 	}
 	return false
 }
+
+// GetDuration will return time.Duration configuration value of a string key.
+// The configuration value is a duration description, such as "15 seconds" or "1 minute".
+func (c Configuration) GetDuration(key string) time.Duration {
+	valStr := c.GetString(key)
+	if len(valStr) == 0 {
+		return 0
+	}
+	dur, err := jiffy.DurationOf(valStr)
+	if err != nil {
+		configLog.Errorf("Invalid duration \"%s\" for configuration \"%s\". Got %s", valStr, key, err)
+		return 0
+	}
+	return dur
+}
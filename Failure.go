@@ -0,0 +1,191 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// failureBodyLimit is how much of a response body is matched against the body pattern.
+	failureBodyLimit = 64 * 1024
+)
+
+var (
+	failureLog = logrus.WithFields(logrus.Fields{
+		"module": "FailureClassifier",
+		"file":   "Failure.go",
+	})
+)
+
+// FailureConfig is how a route classifies the backend responses as failures, as written in the configuration.
+// Unset fields take the global configuration, an empty list or object clears it.
+type FailureConfig struct {
+	StatusCodes []int             `json:"status-codes"`
+	IgnoreCodes []int             `json:"ignore-codes"`
+	Headers     map[string]string `json:"headers"`
+	BodyPattern *string           `json:"body-pattern"`
+}
+
+// NewFailureClassifier creates the FailureClassifier from the configuration. Invalid values are ignored.
+func NewFailureClassifier() *FailureClassifier {
+	fc := &FailureClassifier{
+		Codes:        parseFailureCodes(Config.GetString(FailureStatusCodes)),
+		IgnoredCodes: parseFailureCodes(Config.GetString(FailureIgnoreCodes)),
+		Headers:      make(map[string]*regexp.Regexp),
+	}
+	for _, header := range strings.Split(Config.GetString(FailureHeaders), ",") {
+		name, pattern := header, ""
+		if i := strings.Index(header, ":"); i >= 0 {
+			name, pattern = header[:i], header[i+1:]
+		}
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			failureLog.Errorf("Invalid failure header \"%s\", ignored. got %s", header, err.Error())
+			continue
+		}
+		fc.Headers[http.CanonicalHeaderKey(name)] = re
+	}
+	if pattern := Config.GetString(FailureBodyPattern); len(pattern) > 0 {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			failureLog.Errorf("Invalid failure body pattern \"%s\", ignored. got %s", pattern, err.Error())
+		} else {
+			fc.BodyPattern = re
+		}
+	}
+	return fc
+}
+
+// parseFailureCodes parse the comma separated response codes.
+func parseFailureCodes(codes string) map[int]bool {
+	parsed := make(map[int]bool)
+	for _, code := range strings.Split(codes, ",") {
+		if c, err := strconv.Atoi(strings.TrimSpace(code)); err == nil {
+			parsed[c] = true
+		} else if len(strings.TrimSpace(code)) > 0 {
+			failureLog.Errorf("Invalid failure status code \"%s\", ignored", code)
+		}
+	}
+	return parsed
+}
+
+// FailureClassifier decide whether a backend response is a failure counted by the breakers.
+// The 5xx responses are failures, except the IgnoredCodes, and so are the responses with one of the Codes,
+// one of the Headers or a body matching the BodyPattern. A nil FailureClassifier only counts the 5xx responses.
+type FailureClassifier struct {
+	// Codes are the response codes counted as failures besides 5xx, such as 429 Too Many Requests.
+	Codes map[int]bool
+
+	// IgnoredCodes are the 5xx response codes not counted as failures, such as 501 Not Implemented.
+	IgnoredCodes map[int]bool
+
+	// Headers are the canonical names of the response headers marking a failure, when their value matches.
+	Headers map[string]*regexp.Regexp
+
+	// BodyPattern match the beginning of the bodies of failed responses, nil if the body is not looked at.
+	BodyPattern *regexp.Regexp
+}
+
+// Classify return why the backend response is a failure, nil if it's a success.
+func (fc *FailureClassifier) Classify(recorder *httptest.ResponseRecorder) error {
+	code := recorder.Code
+	if fc == nil {
+		if code >= 500 {
+			return fmt.Errorf("response code %d", code)
+		}
+		return nil
+	}
+	if fc.IgnoredCodes[code] {
+		return nil
+	}
+	if code >= 500 || fc.Codes[code] {
+		return fmt.Errorf("response code %d", code)
+	}
+	for name, pattern := range fc.Headers {
+		for _, value := range recorder.Header()[name] {
+			if pattern.MatchString(value) {
+				return fmt.Errorf("response header %s: %s", name, value)
+			}
+		}
+	}
+	if fc.BodyPattern != nil && recorder.Body != nil {
+		body := recorder.Body.Bytes()
+		if len(body) > failureBodyLimit {
+			body = body[:failureBodyLimit]
+		}
+		if fc.BodyPattern.Match(body) {
+			return fmt.Errorf("response body matches %s", fc.BodyPattern.String())
+		}
+	}
+	return nil
+}
+
+// Override return a copy of the classifier where the fields set in the configuration are replaced.
+func (fc *FailureClassifier) Override(config *FailureConfig) (*FailureClassifier, error) {
+	if config == nil {
+		return fc, nil
+	}
+	overridden := &FailureClassifier{}
+	if fc != nil {
+		*overridden = *fc
+	}
+	if config.StatusCodes != nil {
+		overridden.Codes = make(map[int]bool)
+		for _, code := range config.StatusCodes {
+			overridden.Codes[code] = true
+		}
+	}
+	if config.IgnoreCodes != nil {
+		overridden.IgnoredCodes = make(map[int]bool)
+		for _, code := range config.IgnoreCodes {
+			overridden.IgnoredCodes[code] = true
+		}
+	}
+	if config.Headers != nil {
+		overridden.Headers = make(map[string]*regexp.Regexp)
+		for name, pattern := range config.Headers {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid failure header %s. got %s", name, err.Error())
+			}
+			overridden.Headers[http.CanonicalHeaderKey(name)] = re
+		}
+	}
+	if config.BodyPattern != nil {
+		overridden.BodyPattern = nil
+		if len(*config.BodyPattern) > 0 {
+			re, err := regexp.Compile(*config.BodyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid failure body pattern. got %s", err.Error())
+			}
+			overridden.BodyPattern = re
+		}
+	}
+	return overridden, nil
+}
@@ -0,0 +1,158 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFailureClassifier(t *testing.T) {
+	Config[FailureStatusCodes] = "429, 408"
+	Config[FailureIgnoreCodes] = "501"
+	Config[FailureHeaders] = "X-Maintenance, X-Status: ^down$"
+	Config[FailureBodyPattern] = `"error"\s*:\s*"maintenance"`
+	defer func() {
+		Config[FailureStatusCodes] = ""
+		Config[FailureIgnoreCodes] = ""
+		Config[FailureHeaders] = ""
+		Config[FailureBodyPattern] = ""
+	}()
+	classifier := NewFailureClassifier()
+
+	response := func(code int, header, value, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		if len(header) > 0 {
+			recorder.Header().Set(header, value)
+		}
+		recorder.WriteHeader(code)
+		recorder.Write([]byte(body))
+		return recorder
+	}
+	testData := []struct {
+		recorder *httptest.ResponseRecorder
+		failure  bool
+	}{
+		{response(200, "", "", "ok"), false},
+		{response(404, "", "", "not found"), false},
+		{response(500, "", "", ""), true},
+		{response(503, "", "", ""), true},
+		{response(501, "", "", ""), false},
+		{response(429, "", "", ""), true},
+		{response(408, "", "", ""), true},
+		{response(200, "X-Maintenance", "", ""), true},
+		{response(200, "X-Status", "down", ""), true},
+		{response(200, "X-Status", "up", ""), false},
+		{response(200, "", "", `{"error": "maintenance"}`), true},
+		{response(200, "", "", `{"error": "not found"}`), false},
+	}
+	for i, td := range testData {
+		if err := classifier.Classify(td.recorder); (err != nil) != td.failure {
+			t.Errorf("Expect #%d %d failure %v but %v", i, td.recorder.Code, td.failure, err)
+		}
+	}
+
+	var unset *FailureClassifier
+	if unset.Classify(response(500, "", "", "")) == nil || unset.Classify(response(429, "", "", "")) != nil {
+		t.Errorf("Expect nil classifier to count only 5xx responses")
+	}
+
+	empty := ""
+	overridden, err := classifier.Override(&FailureConfig{StatusCodes: []int{}, IgnoreCodes: []int{503}, BodyPattern: &empty})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overridden.Classify(response(429, "", "", "")) != nil || overridden.Classify(response(503, "", "", "")) != nil ||
+		overridden.Classify(response(200, "", "", `{"error":"maintenance"}`)) != nil {
+		t.Errorf("Expect overridden codes and body pattern to be replaced")
+	}
+	if overridden.Classify(response(200, "X-Maintenance", "", "")) == nil || classifier.Classify(response(429, "", "", "")) == nil {
+		t.Errorf("Expect unset fields kept and the original classifier unchanged")
+	}
+	invalid := "("
+	if _, err := classifier.Override(&FailureConfig{BodyPattern: &invalid}); err == nil {
+		t.Errorf("Expect error for invalid body pattern")
+	}
+}
+
+func TestMaintenanceRoute(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var maintenance int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&maintenance) == 1 && strings.HasPrefix(req.URL.Path, "/shop") {
+			res.WriteHeader(http.StatusOK)
+			res.Write([]byte(`{"error":"maintenance"}`))
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/legacy") {
+			res.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[RoutePolicies] = `[
+		{"prefix": "/shop", "failure": {"body-pattern": "\"error\":\"maintenance\""}},
+		{"prefix": "/legacy", "failure": {"ignore-codes": [501]}}
+	]`
+	defer func() {
+		Config[RoutePolicies] = ""
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	// the ignored 501 do not eject the instance either.
+	instance := handler.Upstreams.Default.Instances[0]
+	for i := 0; i < 7; i++ {
+		MakeCall("GET", "/legacy/report", t, handler)
+	}
+	if resp := MakeCall("GET", "/legacy/report", t, handler); resp.Code != http.StatusNotImplemented || resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect ignored 501 not to open the circuit but %d - %s", resp.Code, resp.Header().Get("X-Circuit"))
+	}
+	if !instance.Available() {
+		t.Errorf("Expect ignored 501 not to eject the instance")
+	}
+
+	if resp := MakeCall("GET", "/shop/cart", t, handler); resp.Body.String() != "backend" {
+		t.Fatalf("Unexpected response %s", resp.Body.String())
+	}
+	atomic.StoreInt32(&maintenance, 1)
+	if resp := MakeCall("GET", "/shop/new", t, handler); resp.Code != http.StatusBadGateway {
+		t.Errorf("Expect maintenance page without stored response to be a bad gateway but %d", resp.Code)
+	}
+	for i := 0; i < 6; i++ {
+		if resp := MakeCall("GET", "/shop/cart", t, handler); resp.Body.String() != "backend" || resp.Header().Get("X-Retter") == "backend" {
+			t.Errorf("Expect maintenance page replaced by the stored response but %s from %s", resp.Body.String(), resp.Header().Get("X-Retter"))
+		}
+	}
+	if resp := MakeCall("GET", "/shop/cart", t, handler); resp.Header().Get("X-Circuit") != "OPEN; level=key" {
+		t.Errorf("Expect maintenance pages to open the circuit but %s", resp.Header().Get("X-Circuit"))
+	}
+	if instance.Available() {
+		t.Errorf("Expect maintenance pages to eject the instance")
+	}
+}
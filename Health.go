@@ -0,0 +1,186 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperjumptech/jiffy"
+	"github.com/hyperjumptech/retter/cache"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// HealthStatus is the body of /health check response.
+type HealthStatus struct {
+	Status                string           `json:"status"`
+	ServerUptime          string           `json:"server-uptime"`
+	CacheCount            int              `json:"cache-count"`
+	CacheBytes            int64            `json:"cache-bytes"`
+	CacheEvictionCount    uint64           `json:"cache-eviction-count"`
+	CacheExpirationCount  uint64           `json:"cache-expiration-count"`
+	CacheRejectedCount    uint64           `json:"cache-rejected-count"`
+	CacheTagCount         int              `json:"cache-tag-count"`
+	LastKnownCount        int              `json:"last-known-count"`
+	LastKnownBytes        int64            `json:"last-known-bytes"`
+	LastKnownEviction     uint64           `json:"last-known-eviction-count"`
+	LastKnownExpiration   uint64           `json:"last-known-expiration-count"`
+	TTLTimerCount         int              `json:"ttl-timer-count"`
+	BreakerCount          int              `json:"breaker-count"`
+	BreakerEvictionCount  uint64           `json:"breaker-eviction-count"`
+	BreakerOverflowCount  uint64           `json:"breaker-overflow-count"`
+	CoalescedCount        uint64           `json:"coalesced-request-count"`
+	CoalesceTimeoutCount  uint64           `json:"coalesce-timeout-count"`
+	RetryCount            uint64           `json:"retry-count"`
+	RetryBudgetExhausted  uint64           `json:"retry-budget-exhausted-count"`
+	HedgeFiredCount       uint64           `json:"hedge-fired-count"`
+	HedgeWonCount         uint64           `json:"hedge-won-count"`
+	TotalRequestServed    uint64           `json:"total-request-served"`
+	TotalResponseTimeMs   uint64           `json:"total-response-time-ms"`
+	AverageResponseTimeMs float64          `json:"average-response-time-ms"`
+	SlowestResponseTimeMs uint64           `json:"slowest-response-time-ms"`
+	FastestResponseTimeMs uint64           `json:"fastest-response-time-ms"`
+	Upstreams             []UpstreamStatus `json:"upstreams"`
+	Memory                MemoryStatus     `json:"memory"`
+}
+
+// UpstreamStatus is the status of an upstream in the /health check response.
+type UpstreamStatus struct {
+	Name             string            `json:"name"`
+	Health           string            `json:"health"`
+	Circuit          string            `json:"circuit"`
+	RouteCircuits    map[string]string `json:"route-circuits"`
+	BreakerCount     int               `json:"breaker-count"`
+	BreakerEvictions uint64            `json:"breaker-eviction-count"`
+	Instances        []InstanceStatus  `json:"instances"`
+}
+
+// InstanceStatus is the status of an upstream instance in the /health check response.
+type InstanceStatus struct {
+	BaseURL     string `json:"baseurl"`
+	Circuit     string `json:"circuit"`
+	Outstanding int64  `json:"outstanding-request-count"`
+	Health      string `json:"health"`
+	LastProbe   string `json:"last-probe,omitempty"`
+	ProbeError  string `json:"last-probe-error,omitempty"`
+}
+
+// MemoryStatus is the memory part of the /health check response.
+type MemoryStatus struct {
+	SysMemoryByte        uint64 `json:"sys-memory-byte"`
+	AllocMemoryByte      uint64 `json:"alloc-memory-byte"`
+	TotalAllocMemoryByte uint64 `json:"total-alloc-memory-byte"`
+}
+
+// ServeHealth writes the health status of this RETTER server as JSON.
+func (rhh *RetterHTTPHandler) ServeHealth(res http.ResponseWriter) {
+	memStat := &runtime.MemStats{}
+	runtime.ReadMemStats(memStat)
+
+	status := &HealthStatus{
+		Status:                "OK",
+		ServerUptime:          jiffy.DescribeDuration(time.Since(ServerStarTime), jiffy.NewWant()),
+		CacheCount:            rhh.Cache.Size(),
+		CacheTagCount:         rhh.Tags.Size(),
+		LastKnownCount:        rhh.LastKnownSuccess.Size(),
+		RetryCount:            rhh.Retry.Retries(),
+		RetryBudgetExhausted:  rhh.Retry.BudgetExhausted(),
+		HedgeFiredCount:       rhh.Hedger.Fired(),
+		HedgeWonCount:         rhh.Hedger.Won(),
+		TotalRequestServed:    rhh.Stats.Count(),
+		TotalResponseTimeMs:   rhh.Stats.TotalMs(),
+		SlowestResponseTimeMs: rhh.Stats.SlowestMs(),
+		FastestResponseTimeMs: rhh.Stats.FastestMs(),
+		Memory: MemoryStatus{
+			SysMemoryByte:        memStat.Sys,
+			AllocMemoryByte:      memStat.Alloc,
+			TotalAllocMemoryByte: memStat.TotalAlloc,
+		},
+	}
+	for _, upstream := range rhh.Upstreams.All() {
+		breakers := upstream.Breakers.Size()
+		evictions := upstream.Breakers.Evictions()
+		status.BreakerCount += breakers
+		status.BreakerEvictionCount += evictions
+		status.BreakerOverflowCount += upstream.Breakers.Overflows()
+		upstreamStatus := UpstreamStatus{
+			Name:             upstream.Name,
+			Health:           healthString(upstream.Up()),
+			Circuit:          getGoBreakerString(upstream.Breaker.State()),
+			RouteCircuits:    upstream.RouteBreakers.Circuits(),
+			BreakerCount:     breakers,
+			BreakerEvictions: evictions,
+		}
+		for _, instance := range upstream.Instances {
+			instanceStatus := InstanceStatus{
+				BaseURL:     instance.BaseURL,
+				Circuit:     getGoBreakerString(instance.Breaker.State()),
+				Outstanding: instance.Outstanding(),
+				Health:      healthString(instance.Healthy()),
+			}
+			if lastProbe, probeError := instance.LastProbe(); !lastProbe.IsZero() {
+				instanceStatus.LastProbe = lastProbe.Format(time.RFC3339)
+				instanceStatus.ProbeError = probeError
+			}
+			upstreamStatus.Instances = append(upstreamStatus.Instances, instanceStatus)
+		}
+		status.Upstreams = append(status.Upstreams, upstreamStatus)
+	}
+	if status.TotalRequestServed > 0 {
+		status.AverageResponseTimeMs = float64(status.TotalResponseTimeMs) / float64(status.TotalRequestServed)
+	}
+	if reporter, ok := rhh.Cache.(cache.StatsReporter); ok {
+		stats := reporter.Stats()
+		status.CacheBytes = stats.Bytes
+		status.CacheEvictionCount = stats.Evictions
+		status.CacheExpirationCount = stats.Expirations
+		status.CacheRejectedCount = stats.Rejected
+	}
+	if reporter, ok := rhh.LastKnownSuccess.(cache.StatsReporter); ok {
+		stats := reporter.Stats()
+		status.LastKnownBytes = stats.Bytes
+		status.LastKnownEviction = stats.Evictions
+		status.LastKnownExpiration = stats.Expirations
+	}
+	if rhh.Coalescer != nil {
+		status.CoalescedCount = rhh.Coalescer.CoalescedCount()
+		status.CoalesceTimeoutCount = rhh.Coalescer.TimedOutCount()
+	}
+	if memStore, ok := rhh.Cache.(*cache.MemoryStore); ok {
+		status.TTLTimerCount = memStore.ExpirySize()
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		serverLog.Errorf("Error while marshaling health status. got %s", err.Error())
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(body)
+}
+
+// healthString return the health as reported in the /health check response.
+func healthString(up bool) string {
+	if up {
+		return "UP"
+	}
+	return "DOWN"
+}
@@ -0,0 +1,206 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	probeLog = logrus.WithFields(logrus.Fields{
+		"module": "HealthChecker",
+		"file":   "HealthCheck.go",
+	})
+)
+
+// instanceHealth is the result of the health probes of an instance.
+type instanceHealth struct {
+	down      bool
+	successes int
+	failures  int
+	lastProbe time.Time
+	lastError string
+	mutex     sync.Mutex
+}
+
+// Healthy check whether the instance is not marked down by the health checker.
+// An instance that is never probed is healthy.
+func (in *Instance) Healthy() bool {
+	in.health.mutex.Lock()
+	defer in.health.mutex.Unlock()
+
+	return !in.health.down
+}
+
+// LastProbe return the time and the error of the last health probe, an empty error if it succeeded.
+func (in *Instance) LastProbe() (time.Time, string) {
+	in.health.mutex.Lock()
+	defer in.health.mutex.Unlock()
+
+	return in.health.lastProbe, in.health.lastError
+}
+
+// recordProbe record the result of a health probe. A healthy instance is marked down after fall
+// consecutive failed probes, and a down instance is marked up after rise consecutive successful probes.
+// Return true if the instance changed from up to down or the other way around.
+func (in *Instance) recordProbe(err error, rise, fall int) bool {
+	in.health.mutex.Lock()
+	defer in.health.mutex.Unlock()
+
+	in.health.lastProbe = time.Now()
+	if err != nil {
+		in.health.lastError = err.Error()
+		in.health.failures++
+		in.health.successes = 0
+		if !in.health.down && in.health.failures >= fall {
+			in.health.down = true
+			return true
+		}
+		return false
+	}
+	in.health.lastError = ""
+	in.health.successes++
+	in.health.failures = 0
+	if in.health.down && in.health.successes >= rise {
+		in.health.down = false
+		return true
+	}
+	return false
+}
+
+// NewHealthChecker creates a HealthChecker for the upstreams from the configuration.
+// Returns nil if no upstream has a health path to probe.
+func NewHealthChecker(upstreams []*Upstream) *HealthChecker {
+	probed := make([]*Upstream, 0)
+	for _, upstream := range upstreams {
+		if len(upstream.HealthPath) > 0 {
+			probed = append(probed, upstream)
+		}
+	}
+	if len(probed) == 0 {
+		return nil
+	}
+	return &HealthChecker{
+		Interval:  Config.GetDuration(HealthCheckInterval),
+		Rise:      Config.GetInt(HealthCheckRise),
+		Fall:      Config.GetInt(HealthCheckFall),
+		upstreams: probed,
+		client:    &http.Client{Timeout: Config.GetDuration(HealthCheckTimeout)},
+		stop:      make(chan bool),
+	}
+}
+
+// HealthChecker periodically calls the health path of each upstream instance, and marks the instances up or down.
+// Instances marked down are not picked by the balancer, so RETTER stops calling them before user requests fail.
+type HealthChecker struct {
+	// Interval is the time between two probes of an instance.
+	Interval time.Duration
+
+	// Rise is the number of consecutive successful probes to mark a down instance up.
+	Rise int
+
+	// Fall is the number of consecutive failed probes to mark an up instance down.
+	Fall int
+
+	upstreams []*Upstream
+	client    *http.Client
+	stop      chan bool
+	wait      sync.WaitGroup
+	once      sync.Once
+}
+
+// Start probing in the background, the first probe is right away.
+func (hc *HealthChecker) Start() {
+	hc.wait.Add(1)
+	go func() {
+		defer hc.wait.Done()
+
+		interval := hc.Interval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			hc.ProbeAll()
+			select {
+			case <-ticker.C:
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// ProbeAll probes every instance once, concurrently, and wait for all of them.
+func (hc *HealthChecker) ProbeAll() {
+	wg := &sync.WaitGroup{}
+	for _, upstream := range hc.upstreams {
+		for _, instance := range upstream.Instances {
+			wg.Add(1)
+			go func(upstream *Upstream, instance *Instance) {
+				defer wg.Done()
+				hc.probe(upstream, instance)
+			}(upstream, instance)
+		}
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) probe(upstream *Upstream, instance *Instance) {
+	err := hc.call(instance.BaseURL + upstream.HealthPath)
+	if instance.recordProbe(err, hc.Rise, hc.Fall) {
+		if err != nil {
+			probeLog.Warnf("backend instance %s of upstream %s is DOWN. got %s", instance.BaseURL, upstream.Name, err.Error())
+		} else {
+			probeLog.Infof("backend instance %s of upstream %s is UP", instance.BaseURL, upstream.Name)
+		}
+	}
+}
+
+// call the health URL, any 2xx or 3xx response is healthy.
+func (hc *HealthChecker) call(url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "retter-health-checker")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close stops probing.
+func (hc *HealthChecker) Close() {
+	hc.once.Do(func() {
+		close(hc.stop)
+		hc.wait.Wait()
+		hc.client.CloseIdleConnections()
+	})
+}
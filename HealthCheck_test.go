@@ -0,0 +1,134 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProbeHysteresis(t *testing.T) {
+	instance := NewInstance("http://instance", InstanceBreakerPolicy{ConsecutiveFail: 1})
+	failed := errors.New("connection refused")
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{nil, true},
+		{failed, true},
+		{nil, true},
+		{failed, true},
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{failed, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		instance.recordProbe(step.err, 2, 3)
+		if instance.Healthy() != step.healthy || instance.Available() != step.healthy {
+			t.Errorf("Expect healthy %v after probe #%d", step.healthy, i)
+		}
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var down int32
+	var calls int64
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			if atomic.LoadInt32(&down) == 1 {
+				res.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddInt64(&calls, 1)
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[HealthCheckPath] = "/healthz"
+	Config[HealthCheckInterval] = "1 hour"
+	Config[HealthCheckFall] = "2"
+	defer func() {
+		Config[HealthCheckPath] = ""
+		Config[HealthCheckInterval] = "10 seconds"
+		Config[HealthCheckFall] = "3"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+	if handler.HealthChecker == nil {
+		t.Fatal("Expect health checker when the health path is configured")
+	}
+	// stop the background probes, so only the probes of this test are counted.
+	handler.HealthChecker.Close()
+
+	if resp := MakeCall("GET", "/cached", t, handler); resp.Header().Get("X-Retter") != "backend" {
+		t.Fatalf("Expect call to healthy backend but %s", resp.Header().Get("X-Retter"))
+	}
+
+	atomic.StoreInt32(&down, 1)
+	handler.HealthChecker.ProbeAll()
+	if !handler.Upstreams.Default.Up() {
+		t.Errorf("Expect instance up after a single failed probe")
+	}
+	handler.HealthChecker.ProbeAll()
+	if handler.Upstreams.Default.Up() {
+		t.Fatalf("Expect instance down after consecutive failed probes")
+	}
+
+	before := atomic.LoadInt64(&calls)
+	if resp := MakeCall("GET", "/cached", t, handler); resp.Header().Get("X-Retter") != "cache" || resp.Body.String() != "backend" {
+		t.Errorf("Expect response from cache but %s - %s", resp.Header().Get("X-Retter"), resp.Body.String())
+	}
+	if resp := MakeCall("GET", "/never-cached", t, handler); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expect 503 without cached response but %d", resp.Code)
+	}
+	if atomic.LoadInt64(&calls) != before {
+		t.Errorf("Expect no backend call while every instance is down")
+	}
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	instance := health.Upstreams[0].Instances[0]
+	if health.Upstreams[0].Health != "DOWN" || instance.Health != "DOWN" || len(instance.LastProbe) == 0 || len(instance.ProbeError) == 0 {
+		t.Errorf("Unexpected upstream health %v", health.Upstreams[0])
+	}
+
+	atomic.StoreInt32(&down, 0)
+	handler.HealthChecker.ProbeAll()
+	handler.HealthChecker.ProbeAll()
+	if resp := MakeCall("GET", "/never-cached", t, handler); resp.Header().Get("X-Retter") != "backend" {
+		t.Errorf("Expect call to recovered backend but %s", resp.Header().Get("X-Retter"))
+	}
+}
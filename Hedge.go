@@ -0,0 +1,189 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	hedgeLog = logrus.WithFields(logrus.Fields{
+		"module": "Hedger",
+		"file":   "Hedge.go",
+	})
+)
+
+const (
+	// hedgeSamples is the number of recent backend latencies the hedge percentile is computed from.
+	hedgeSamples = 256
+
+	// hedgeMinSamples is the number of latencies to observe before the percentile is used instead of the fixed delay.
+	hedgeMinSamples = 20
+)
+
+// NewHedger creates a Hedger from the configuration.
+func NewHedger() *Hedger {
+	return &Hedger{
+		Delay:      Config.GetDuration(HedgeDelay),
+		Percentile: Config.GetFloat(HedgePercentile),
+		latencies:  make([]time.Duration, 0, hedgeSamples),
+	}
+}
+
+// Hedger fire a second identical backend call when the first one has not answered in time,
+// and use whichever answers first. The loser is cancelled. Only GET and HEAD requests are hedged.
+type Hedger struct {
+	// Delay is how long to wait for the first call before firing the hedge, zero disables hedging.
+	// When Percentile is set, it's only used until enough latencies are observed.
+	Delay time.Duration
+
+	// Percentile of the recent backend latencies to wait before firing the hedge, such as 0.95. Zero uses Delay.
+	Percentile float64
+
+	mutex     sync.Mutex
+	latencies []time.Duration
+	next      int
+	fired     uint64
+	won       uint64
+}
+
+type hedgeResult struct {
+	recorder *httptest.ResponseRecorder
+	hedge    bool
+	took     time.Duration
+}
+
+// Hedgeable check whether the request may be hedged.
+func (h *Hedger) Hedgeable(req *http.Request) bool {
+	if h.Delay <= 0 {
+		return false
+	}
+	method := strings.ToUpper(req.Method)
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// Do make the call, and a second one if the first has not answered after the hedge delay.
+// Return the first successful response, or the last one if both failed.
+// The failure classifier tells which responses are failures, nil counts the 5xx responses.
+func (h *Hedger) Do(req *http.Request, failure *FailureClassifier, call func(req *http.Request) *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	if !h.Hedgeable(req) {
+		return call(req)
+	}
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	start := func(hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		go func() {
+			started := time.Now()
+			recorder := call(req.WithContext(ctx))
+			results <- hedgeResult{recorder: recorder, hedge: hedge, took: time.Since(started)}
+		}()
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	start(false)
+	pending := 1
+	timer := time.NewTimer(h.hedgeDelay())
+	defer timer.Stop()
+
+	var result hedgeResult
+	for {
+		select {
+		case result = <-results:
+			pending--
+		case <-timer.C:
+			atomic.AddUint64(&h.fired, 1)
+			hedgeLog.Debugf("%s is slow, firing a hedge", req.URL.Path)
+			start(true)
+			pending++
+			continue
+		}
+		if failure.Classify(result.recorder) == nil {
+			h.observe(result.took)
+			if result.hedge {
+				atomic.AddUint64(&h.won, 1)
+			}
+			return result.recorder
+		}
+		// a failed call before the hedge is fired is not hedged, the retries take care of it.
+		if pending == 0 {
+			return result.recorder
+		}
+	}
+}
+
+// hedgeDelay return how long to wait for the first call before firing the hedge.
+func (h *Hedger) hedgeDelay() time.Duration {
+	if h.Percentile <= 0 {
+		return h.Delay
+	}
+	h.mutex.Lock()
+	if len(h.latencies) < hedgeMinSamples {
+		h.mutex.Unlock()
+		return h.Delay
+	}
+	sorted := make([]time.Duration, len(h.latencies))
+	copy(sorted, h.latencies)
+	h.mutex.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	index := int(h.Percentile * float64(len(sorted)))
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+// observe record the latency of a successful backend call.
+func (h *Hedger) observe(latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.latencies) < hedgeSamples {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// Fired return the number of hedges fired.
+func (h *Hedger) Fired() uint64 {
+	return atomic.LoadUint64(&h.fired)
+}
+
+// Won return the number of hedges that answered before the call they hedged.
+func (h *Hedger) Won() uint64 {
+	return atomic.LoadUint64(&h.won)
+}
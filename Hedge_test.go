@@ -0,0 +1,133 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	hedger := &Hedger{Delay: time.Second, Percentile: 0.9}
+	for i := 1; i < hedgeMinSamples; i++ {
+		hedger.observe(time.Duration(i) * time.Millisecond)
+	}
+	if delay := hedger.hedgeDelay(); delay != time.Second {
+		t.Errorf("Expect fixed delay until enough latencies are observed but %s", delay)
+	}
+	for i := hedgeMinSamples; i <= 100; i++ {
+		hedger.observe(time.Duration(i) * time.Millisecond)
+	}
+	if delay := hedger.hedgeDelay(); delay != 91*time.Millisecond {
+		t.Errorf("Expect the 90th percentile latency but %s", delay)
+	}
+	for i := 0; i < 2*hedgeSamples; i++ {
+		hedger.observe(5 * time.Millisecond)
+	}
+	if delay := hedger.hedgeDelay(); delay != 5*time.Millisecond {
+		t.Errorf("Expect only recent latencies to count but %s", delay)
+	}
+}
+
+func TestHedgedRequests(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var calls, cancelled int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// only the first call of /slow is slow
+		if atomic.AddInt32(&calls, 1) == 1 && req.URL.Path == "/slow" {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-req.Context().Done():
+				atomic.AddInt32(&cancelled, 1)
+				return
+			}
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[HedgeDelay] = "100 milliseconds"
+	defer func() {
+		Config[HedgeDelay] = "0 seconds"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	started := time.Now()
+	resp := MakeCall("GET", "/slow", t, handler)
+	if resp.Code != http.StatusOK || resp.Body.String() != "backend" || time.Since(started) > time.Second {
+		t.Errorf("Expect the hedge to answer but %d - %s after %s", resp.Code, resp.Body.String(), time.Since(started))
+	}
+	if handler.Hedger.Fired() != 1 || handler.Hedger.Won() != 1 {
+		t.Errorf("Expect 1 hedge fired and won but %d fired, %d won", handler.Hedger.Fired(), handler.Hedger.Won())
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&cancelled) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("Expect the slow call to be cancelled")
+	}
+	if resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect the cancelled call not to count as failure but circuit %s", resp.Header().Get("X-Circuit"))
+	}
+
+	// fast calls and POST are not hedged
+	atomic.StoreInt32(&calls, 1)
+	MakeCall("GET", "/fast", t, handler)
+	MakeCall("POST", "/fast", t, handler)
+	if atomic.LoadInt32(&calls) != 3 || handler.Hedger.Fired() != 1 {
+		t.Errorf("Expect no more hedge but %d calls, %d fired", calls, handler.Hedger.Fired())
+	}
+}
+
+func TestHedgeFailureClassifier(t *testing.T) {
+	hedger := &Hedger{Delay: 10 * time.Millisecond}
+	failure := &FailureClassifier{Codes: map[int]bool{http.StatusTooManyRequests: true}}
+
+	var calls int32
+	resp := hedger.Do(httptest.NewRequest("GET", "/slow", nil), failure, func(req *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		// the hedge answers first, but with a failure of the route
+		if atomic.AddInt32(&calls, 1) == 2 {
+			recorder.WriteHeader(http.StatusTooManyRequests)
+			return recorder
+		}
+		select {
+		case <-time.After(200 * time.Millisecond):
+			recorder.WriteHeader(http.StatusOK)
+		case <-req.Context().Done():
+			recorder.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return recorder
+	})
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expect the successful call to win over the failed hedge but %d", resp.Code)
+	}
+	if hedger.Fired() != 1 || hedger.Won() != 0 {
+		t.Errorf("Expect 1 hedge fired and lost but %d fired, %d won", hedger.Fired(), hedger.Won())
+	}
+}
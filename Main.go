@@ -79,13 +79,14 @@ func startServer() {
 		panic(err)
 	}
 
+	handler := NewRetterHTTPHandler()
 	srv := &http.Server{
 		Addr: listen,
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: WriteTimeout,
 		ReadTimeout:  ReadTimeout,
 		IdleTimeout:  IdleTimeout,
-		Handler:      NewRetterHTTPHandler(), // Pass our instance of gorilla/mux in.
+		Handler:      handler, // Pass our instance of gorilla/mux in.
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
@@ -96,15 +97,41 @@ func startServer() {
 		}
 		log.Infof("This RETTER instance will forwards GET request...")
 		log.Infof("  From : %s/*", l)
-		log.Infof("  To   : %s/*", Config.GetString(BackendURL))
+		for _, upstream := range handler.Upstreams.All() {
+			for _, instance := range upstream.Instances {
+				log.Infof("  To   : %s/* (upstream %s, hosts %v, path prefix \"%s\")", instance.BaseURL, upstream.Name, upstream.Hosts, upstream.PathPrefix)
+			}
+		}
 		log.Infof("URL Query Detect       : %s", Config.GetString(CacheDetectQuery))
 		log.Infof("URL Session Detect     : %s", Config.GetString(CacheDetectSession))
+		log.Infof("Cache Store            : %s", Config.GetString(CacheStore))
 		log.Infof("RETTER is listening on : [%s]", l)
 		if err := srv.ListenAndServe(); err != nil {
 			log.Println(err)
 		}
 	}()
 
+	var adminSrv *http.Server
+	if adminListen := Config.GetString(AdminListen); len(adminListen) > 0 {
+		if token := Config.GetString(AdminToken); len(token) == 0 {
+			log.Errorf("admin.listen is configured without admin.token, the admin API is not started")
+		} else {
+			adminSrv = &http.Server{
+				Addr:         adminListen,
+				WriteTimeout: WriteTimeout,
+				ReadTimeout:  ReadTimeout,
+				IdleTimeout:  IdleTimeout,
+				Handler:      NewAdminHTTPHandler(handler, token),
+			}
+			go func() {
+				log.Infof("RETTER admin API is listening on : [%s]", adminListen)
+				if err := adminSrv.ListenAndServe(); err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
@@ -120,6 +147,10 @@ func startServer() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
+	if adminSrv != nil {
+		adminSrv.Shutdown(ctx)
+	}
+	handler.Close()
 
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
@@ -0,0 +1,288 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	retryLog = logrus.WithFields(logrus.Fields{
+		"module": "RetryPolicy",
+		"file":   "Retry.go",
+	})
+)
+
+const (
+	// retryBudgetWindow is how long the requests and retries are counted before the budget is reset.
+	retryBudgetWindow = 10 * time.Second
+)
+
+// NewRetryPolicy creates a RetryPolicy from the configuration.
+func NewRetryPolicy() *RetryPolicy {
+	policy := &RetryPolicy{
+		Max:        Config.GetInt(RetryMax),
+		Methods:    make([]string, 0),
+		Codes:      make([]int, 0),
+		Backoff:    Config.GetDuration(RetryBackoff),
+		MaxBackoff: Config.GetDuration(RetryBackoffMax),
+		Budget: &RetryBudget{
+			Ratio:      Config.GetFloat(RetryBudgetRatio),
+			MinRetries: int64(Config.GetInt(RetryBudgetMin)),
+		},
+	}
+	for _, method := range strings.Split(Config.GetString(RetryMethods), ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); len(method) > 0 {
+			policy.Methods = append(policy.Methods, method)
+		}
+	}
+	for _, code := range strings.Split(Config.GetString(RetryStatusCodes), ",") {
+		if c, err := strconv.Atoi(strings.TrimSpace(code)); err == nil {
+			policy.Codes = append(policy.Codes, c)
+		} else if len(strings.TrimSpace(code)) > 0 {
+			retryLog.Errorf("Invalid retry status code \"%s\", ignored", code)
+		}
+	}
+	return policy
+}
+
+// RetryPolicy decide whether and when a failed backend call is tried again.
+// Only the connection errors (502), the timeouts (504) and the status codes in Codes are retried,
+// only for the requests with one of the Methods, and as long as the Budget allows it.
+type RetryPolicy struct {
+	// Max is the number of retries after the first attempt, zero disables retries.
+	Max int
+
+	// Methods are the request methods to retry, they must be idempotent.
+	Methods []string
+
+	// Codes are the backend response codes to retry besides 502 and 504.
+	Codes []int
+
+	// Backoff is the delay before the first retry, doubled for each following retry.
+	Backoff time.Duration
+
+	// MaxBackoff is the longest delay before a retry. A Retry-After longer than this is not waited for.
+	MaxBackoff time.Duration
+
+	// Budget limit the retries to a ratio of the requests, so the retries can not amplify an outage.
+	Budget *RetryBudget
+
+	retries   uint64
+	exhausted uint64
+}
+
+// Retryable check whether the request may be retried at all.
+func (rp *RetryPolicy) Retryable(req *http.Request) bool {
+	if rp.Max <= 0 {
+		return false
+	}
+	for _, method := range rp.Methods {
+		if method == strings.ToUpper(req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryableCode check whether a response code is worth retrying. The connection errors and timeouts
+// are always retried, whatever the configured Codes.
+func (rp *RetryPolicy) retryableCode(code int) bool {
+	if code == http.StatusBadGateway || code == http.StatusGatewayTimeout {
+		return true
+	}
+	for _, c := range rp.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Do make the call, and retry it while the response is retryable. Return the response of the last attempt.
+// The request body is buffered so each attempt sends it whole.
+func (rp *RetryPolicy) Do(req *http.Request, call func(req *http.Request) *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	if !rp.Retryable(req) {
+		return call(req)
+	}
+	rp.Budget.Request()
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(http.StatusBadRequest)
+			recorder.Write([]byte(err.Error()))
+			return recorder
+		}
+	}
+	attemptRequest := func() *http.Request {
+		if body == nil {
+			return req
+		}
+		attempt := req.Clone(req.Context())
+		attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return attempt
+	}
+
+	recorder := call(attemptRequest())
+	for attempt := 1; attempt <= rp.Max; attempt++ {
+		if !rp.retryableCode(recorder.Code) {
+			return recorder
+		}
+		delay, ok := rp.delay(attempt, recorder)
+		if !ok {
+			return recorder
+		}
+		if !rp.Budget.Withdraw() {
+			atomic.AddUint64(&rp.exhausted, 1)
+			retryLog.Debugf("retry budget exhausted, %s is not retried", req.URL.Path)
+			return recorder
+		}
+		if !sleep(req, delay) {
+			return recorder
+		}
+		atomic.AddUint64(&rp.retries, 1)
+		retryLog.Debugf("retry #%d of %s after response code %d", attempt, req.URL.Path, recorder.Code)
+		recorder = call(attemptRequest())
+	}
+	return recorder
+}
+
+// delay return how long to wait before the retry attempt, exponential backoff with jitter, or the backend's
+// Retry-After. Return false if the backend asks to wait longer than MaxBackoff.
+func (rp *RetryPolicy) delay(attempt int, recorder *httptest.ResponseRecorder) (time.Duration, bool) {
+	if retryAfter, ok := RetryAfter(recorder.Header(), time.Now()); ok {
+		return retryAfter, retryAfter <= rp.MaxBackoff
+	}
+	backoff := rp.Backoff << uint(attempt-1)
+	if backoff > rp.MaxBackoff || backoff <= 0 {
+		backoff = rp.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+	// equal jitter, half of the backoff plus a random part of the other half.
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// Retries return the number of retries made.
+func (rp *RetryPolicy) Retries() uint64 {
+	return atomic.LoadUint64(&rp.retries)
+}
+
+// BudgetExhausted return the number of retries refused by the budget.
+func (rp *RetryPolicy) BudgetExhausted() uint64 {
+	return atomic.LoadUint64(&rp.exhausted)
+}
+
+// RetryAfter parse the Retry-After header, either delay seconds or a HTTP date.
+func RetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if len(value) == 0 {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// sleep for the duration, unless the request is cancelled first. Return false if the request is cancelled.
+func sleep(req *http.Request, duration time.Duration) bool {
+	if duration <= 0 {
+		return req.Context().Err() == nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// RetryBudget allows retries up to a Ratio of the requests made in the last window, plus MinRetries,
+// so a failing backend gets at most that much extra load. It's safe for concurrent use.
+type RetryBudget struct {
+	// Ratio is the number of retries allowed for each request, 0.1 means at most 10% extra load.
+	Ratio float64
+
+	// MinRetries is the number of retries allowed in a window regardless of the Ratio, so low traffic may retry.
+	MinRetries int64
+
+	windowStart time.Time
+	requests    int64
+	retries     int64
+	mutex       sync.Mutex
+}
+
+// reset start a new window if the current one is over. The mutex must be held.
+func (rb *RetryBudget) reset(now time.Time) {
+	if now.Sub(rb.windowStart) >= retryBudgetWindow {
+		rb.windowStart = now
+		rb.requests = 0
+		rb.retries = 0
+	}
+}
+
+// Request record a request that may be retried.
+func (rb *RetryBudget) Request() {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.reset(time.Now())
+	rb.requests++
+}
+
+// Withdraw a retry from the budget. Return false if the budget is exhausted.
+func (rb *RetryBudget) Withdraw() bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.reset(time.Now())
+	if float64(rb.retries) >= rb.Ratio*float64(rb.requests)+float64(rb.MinRetries) {
+		return false
+	}
+	rb.retries++
+	return true
+}
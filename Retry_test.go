@@ -0,0 +1,151 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"3":                             3 * time.Second,
+		"Mon, 01 Mar 2021 10:00:05 GMT": 5 * time.Second,
+		"Mon, 01 Mar 2021 09:00:00 GMT": 0,
+	} {
+		header := http.Header{}
+		header.Set("Retry-After", value)
+		if delay, ok := RetryAfter(header, now); !ok || delay != expected {
+			t.Errorf("Expect %s for %s but %s", expected, value, delay)
+		}
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		header := http.Header{}
+		header.Set("Retry-After", value)
+		if _, ok := RetryAfter(header, now); ok {
+			t.Errorf("Expect no delay for \"%s\"", value)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &RetryBudget{Ratio: 0.1, MinRetries: 1}
+	for i := 0; i < 20; i++ {
+		budget.Request()
+	}
+	for i := 0; i < 3; i++ {
+		if !budget.Withdraw() {
+			t.Fatalf("Expect retry #%d within the budget", i)
+		}
+	}
+	if budget.Withdraw() {
+		t.Errorf("Expect budget exhausted after 10%% of the requests plus the minimum")
+	}
+}
+
+func TestRetryableCode(t *testing.T) {
+	policy := &RetryPolicy{Codes: []int{429}}
+	for code, retryable := range map[int]bool{
+		http.StatusBadGateway:          true,
+		http.StatusGatewayTimeout:      true,
+		http.StatusTooManyRequests:     true,
+		http.StatusServiceUnavailable:  false,
+		http.StatusInternalServerError: false,
+		http.StatusNotFound:            false,
+	} {
+		if policy.retryableCode(code) != retryable {
+			t.Errorf("Expect %d retryable %v", code, retryable)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var calls, failures int64
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if strings.HasPrefix(req.URL.Path, "/later") {
+			res.Header().Set("Retry-After", "60")
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if atomic.AddInt64(&failures, -1) >= 0 || req.Method == http.MethodPost {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[RetryMax] = "2"
+	Config[RetryBackoff] = "1 millisecond"
+	Config[RetryBudgetMin] = "20"
+	defer func() {
+		Config[RetryMax] = "0"
+		Config[RetryBackoff] = "100 milliseconds"
+		Config[RetryBudgetMin] = "3"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	// two failures then success, each request is a single breaker outcome.
+	// Counted per attempt, the failure rate would trip the breaker.
+	for i := 0; i < 6; i++ {
+		atomic.StoreInt64(&failures, 2)
+		resp := MakeCall("GET", "/flaky", t, handler)
+		if resp.Code != http.StatusOK || resp.Header().Get("X-Retter") != "backend" || resp.Header().Get("X-Circuit") != "CLOSED" {
+			t.Fatalf("Expect success after 2 retries but %d from %s, circuit %s", resp.Code, resp.Header().Get("X-Retter"), resp.Header().Get("X-Circuit"))
+		}
+	}
+	if atomic.LoadInt64(&calls) != 18 {
+		t.Errorf("Expect 3 calls for each request but %d", calls)
+	}
+
+	// POST is not retried.
+	atomic.StoreInt64(&calls, 0)
+	if resp := MakeCall("POST", "/flaky", t, handler); resp.Code != http.StatusServiceUnavailable || atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("Expect POST not retried but %d after %d calls", resp.Code, calls)
+	}
+
+	// a Retry-After longer than the max backoff is not waited for.
+	atomic.StoreInt64(&calls, 0)
+	MakeCall("GET", "/later", t, handler)
+	if atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("Expect no retry with a long Retry-After but %d calls", calls)
+	}
+
+	// the budget stops the retries of an outage.
+	atomic.StoreInt64(&failures, 1000)
+	for i := 0; i < 10; i++ {
+		MakeCall("GET", fmt.Sprintf("/down/%d", i), t, handler)
+	}
+	if handler.Retry.BudgetExhausted() == 0 || handler.Retry.Retries() > 12+20+2 {
+		t.Errorf("Expect retries limited by the budget but %d retries, %d refused", handler.Retry.Retries(), handler.Retry.BudgetExhausted())
+	}
+}
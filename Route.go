@@ -0,0 +1,407 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperjumptech/jiffy"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// RouteDefault is the name of the policy for requests not matching any configured route.
+	RouteDefault = "default"
+)
+
+// BreakerConfig is the circuit breaker thresholds of a route as written in the configuration.
+// Zero fields take the global configuration.
+type BreakerConfig struct {
+	MaxRequests     uint32  `json:"max-requests"`
+	Interval        string  `json:"interval"`
+	Timeout         string  `json:"timeout"`
+	FailureRate     float64 `json:"fail-rate"`
+	ConsecutiveFail int     `json:"consecutive-fail"`
+	MinRequests     uint32  `json:"min-requests"`
+
+	SlowCallDuration    string  `json:"slow-call-duration"`
+	SlowCallRate        float64 `json:"slow-call-rate"`
+	SlowCallMinRequests uint32  `json:"slow-call-min-requests"`
+
+	Window        string `json:"window"`
+	WindowSize    int    `json:"window-size"`
+	WindowBuckets int    `json:"window-buckets"`
+}
+
+// RouteConfig is a route policy as written in the configuration. A route matches the request path
+// by exactly one of Prefix, Regex or Glob, where * in a glob matches any characters.
+// Unset fields take the global configuration.
+type RouteConfig struct {
+	Name             string         `json:"name"`
+	Prefix           string         `json:"prefix"`
+	Regex            string         `json:"regex"`
+	Glob             string         `json:"glob"`
+	Breaker          *BreakerConfig `json:"breaker"`
+	WriteBreaker     *BreakerConfig `json:"write-breaker"`
+	RouteBreaker     *BreakerConfig `json:"route-breaker"`
+	PerKeyBreaker    *bool          `json:"per-key-breaker"`
+	Failure          *FailureConfig `json:"failure"`
+	CacheTTL         *int           `json:"cache-ttl"`
+	BackendTimeout   string         `json:"backend-timeout"`
+	CacheableMethods []string       `json:"cacheable-methods"`
+}
+
+// BreakerPolicy is the resolved circuit breaker thresholds of a route.
+type BreakerPolicy struct {
+	// MaxRequests is the number of requests allowed to pass while the breaker is half-open.
+	MaxRequests uint32
+
+	// Interval is the cyclic period of the closed state to clear the counts, zero never clear.
+	// With the time Window, it's the length of the sliding window.
+	Interval time.Duration
+
+	// Timeout is the period of the open state before the breaker becomes half-open, zero is 60 seconds.
+	Timeout time.Duration
+
+	// FailureRate trips the breaker once the rate of failures exceeds it, after MinRequests requests.
+	FailureRate float64
+
+	// ConsecutiveFail trips the breaker once the number of consecutive failures exceeds it.
+	ConsecutiveFail int
+
+	// MinRequests is the number of requests in the interval before FailureRate is considered.
+	MinRequests uint32
+
+	// SlowCallDuration is the duration from which a call is slow, zero disables slow call tripping.
+	SlowCallDuration time.Duration
+
+	// SlowCallRate trips the breaker once the rate of slow calls reaches it, after SlowCallMinRequests requests.
+	// Zero disables slow call tripping.
+	SlowCallRate float64
+
+	// SlowCallMinRequests is the number of requests in the interval before SlowCallRate is considered.
+	SlowCallMinRequests uint32
+
+	// Window is how the calls are counted, fixed intervals, the last WindowSize calls (count)
+	// or the calls of the last Interval in WindowBuckets buckets (time).
+	Window string
+
+	// WindowSize is the number of calls counted by the count window.
+	WindowSize int
+
+	// WindowBuckets is the number of buckets of the time window.
+	WindowBuckets int
+}
+
+// RoutePolicy is how the requests of a route are protected. The cacheable requests of the route share
+// the RouteBreaker, and each request key has its own Breaker if PerKeyBreaker. WriteBreaker protects
+// the other requests, such as POST, which fail fast instead of being served from cache.
+// Failure tells which backend responses are counted as failures by these breakers.
+type RoutePolicy struct {
+	Name             string
+	Breaker          BreakerPolicy
+	WriteBreaker     BreakerPolicy
+	RouteBreaker     BreakerPolicy
+	PerKeyBreaker    bool
+	Failure          *FailureClassifier
+	CachePolicy      *CachePolicy
+	BackendTimeout   time.Duration
+	CacheableMethods []string
+
+	match func(path string) bool
+}
+
+// Matches check whether the request belongs to this route.
+func (rp *RoutePolicy) Matches(req *http.Request) bool {
+	return rp.match == nil || rp.match(req.URL.Path)
+}
+
+// Cacheable check whether requests with the method are cached and circuit breaked in this route.
+func (rp *RoutePolicy) Cacheable(method string) bool {
+	for _, m := range rp.CacheableMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// BreakerPolicy return the breaker thresholds for requests with the method in this route.
+func (rp *RoutePolicy) BreakerPolicy(method string) BreakerPolicy {
+	if rp.Cacheable(method) {
+		return rp.Breaker
+	}
+	return rp.WriteBreaker
+}
+
+// RouteTable picks the policy of each request, the first matching route wins.
+type RouteTable struct {
+	Routes  []*RoutePolicy
+	Default *RoutePolicy
+}
+
+// Match return the policy of the first route matching the request, or the default policy.
+func (rt *RouteTable) Match(req *http.Request) *RoutePolicy {
+	for _, route := range rt.Routes {
+		if route.Matches(req) {
+			return route
+		}
+	}
+	return rt.Default
+}
+
+// NewDefaultRoutePolicy creates the policy for requests not matching any route, from the global configuration.
+func NewDefaultRoutePolicy() *RoutePolicy {
+	return &RoutePolicy{
+		Name: RouteDefault,
+		Breaker: BreakerPolicy{
+			MaxRequests:     1,
+			Interval:        10 * time.Second,
+			Timeout:         0,
+			FailureRate:     Config.GetFloat(FailureRate),
+			ConsecutiveFail: Config.GetInt(ConsecutiveFail),
+			MinRequests:     5,
+
+			SlowCallDuration:    Config.GetDuration(SlowCallDuration),
+			SlowCallRate:        Config.GetFloat(SlowCallRate),
+			SlowCallMinRequests: uint32(Config.GetInt(SlowCallMinRequests)),
+
+			Window:        Config.GetString(BreakerWindow),
+			WindowSize:    Config.GetInt(BreakerWindowSize),
+			WindowBuckets: Config.GetInt(BreakerWindowBuckets),
+		},
+		WriteBreaker: BreakerPolicy{
+			MaxRequests:     1,
+			Interval:        10 * time.Second,
+			Timeout:         Config.GetDuration(WriteOpenTimeout),
+			FailureRate:     Config.GetFloat(WriteFailureRate),
+			ConsecutiveFail: Config.GetInt(WriteConsecutiveFail),
+			MinRequests:     5,
+
+			SlowCallDuration:    Config.GetDuration(SlowCallDuration),
+			SlowCallRate:        Config.GetFloat(SlowCallRate),
+			SlowCallMinRequests: uint32(Config.GetInt(SlowCallMinRequests)),
+
+			Window:        Config.GetString(BreakerWindow),
+			WindowSize:    Config.GetInt(BreakerWindowSize),
+			WindowBuckets: Config.GetInt(BreakerWindowBuckets),
+		},
+		RouteBreaker:     NewAggregateBreakerPolicy(Config.GetFloat(RouteFailureRate), Config.GetInt(RouteMinRequests)),
+		PerKeyBreaker:    Config.GetBoolean(BreakerPerKey),
+		Failure:          NewFailureClassifier(),
+		CachePolicy:      NewCachePolicy(),
+		BackendTimeout:   Config.GetDuration(BackendTimeout),
+		CacheableMethods: []string{http.MethodGet},
+	}
+}
+
+// NewRouteTable creates the RouteTable from the configuration. The route.policies configuration
+// is either a JSON array of RouteConfig or the path of a file containing it.
+func NewRouteTable() (*RouteTable, error) {
+	routes := strings.TrimSpace(Config.GetString(RoutePolicies))
+	if len(routes) > 0 && !strings.HasPrefix(routes, "[") {
+		data, err := ioutil.ReadFile(routes)
+		if err != nil {
+			return nil, err
+		}
+		routes = string(data)
+	}
+	return ParseRouteTable(routes, NewDefaultRoutePolicy())
+}
+
+// ParseRouteTable creates a RouteTable from a JSON array of RouteConfig.
+// Unset fields of each route take the value of the default policy.
+func ParseRouteTable(routesJSON string, defaultPolicy *RoutePolicy) (*RouteTable, error) {
+	table := &RouteTable{
+		Routes:  make([]*RoutePolicy, 0),
+		Default: defaultPolicy,
+	}
+	if len(strings.TrimSpace(routesJSON)) == 0 {
+		return table, nil
+	}
+	configs := make([]*RouteConfig, 0)
+	if err := json.Unmarshal([]byte(routesJSON), &configs); err != nil {
+		return nil, fmt.Errorf("invalid route policies. got %s", err.Error())
+	}
+	for i, config := range configs {
+		route, err := newRoutePolicy(config, defaultPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route policy #%d. got %s", i+1, err.Error())
+		}
+		table.Routes = append(table.Routes, route)
+	}
+	return table, nil
+}
+
+func newRoutePolicy(config *RouteConfig, defaultPolicy *RoutePolicy) (*RoutePolicy, error) {
+	route := &RoutePolicy{
+		Name:             config.Name,
+		Breaker:          defaultPolicy.Breaker,
+		WriteBreaker:     defaultPolicy.WriteBreaker,
+		RouteBreaker:     defaultPolicy.RouteBreaker,
+		PerKeyBreaker:    defaultPolicy.PerKeyBreaker,
+		Failure:          defaultPolicy.Failure,
+		BackendTimeout:   defaultPolicy.BackendTimeout,
+		CacheableMethods: defaultPolicy.CacheableMethods,
+	}
+
+	matchers := 0
+	if len(config.Prefix) > 0 {
+		matchers++
+		prefix := config.Prefix
+		route.match = func(path string) bool {
+			return strings.HasPrefix(path, prefix)
+		}
+	}
+	if len(config.Regex) > 0 {
+		matchers++
+		pattern, err := regexp.Compile(config.Regex)
+		if err != nil {
+			return nil, err
+		}
+		route.match = pattern.MatchString
+	}
+	if len(config.Glob) > 0 {
+		matchers++
+		pattern, err := globRegexp(config.Glob)
+		if err != nil {
+			return nil, err
+		}
+		route.match = pattern.MatchString
+	}
+	if matchers != 1 {
+		return nil, fmt.Errorf("route must have exactly one of prefix, regex or glob")
+	}
+	if len(route.Name) == 0 {
+		route.Name = config.Prefix + config.Regex + config.Glob
+	}
+
+	if err := applyBreakerConfig(&route.Breaker, config.Breaker); err != nil {
+		return nil, err
+	}
+	if err := applyBreakerConfig(&route.WriteBreaker, config.WriteBreaker); err != nil {
+		return nil, err
+	}
+	if err := applyBreakerConfig(&route.RouteBreaker, config.RouteBreaker); err != nil {
+		return nil, err
+	}
+	if config.PerKeyBreaker != nil {
+		route.PerKeyBreaker = *config.PerKeyBreaker
+	}
+	failure, err := defaultPolicy.Failure.Override(config.Failure)
+	if err != nil {
+		return nil, err
+	}
+	route.Failure = failure
+
+	cachePolicy := *defaultPolicy.CachePolicy
+	if config.CacheTTL != nil {
+		cachePolicy.DefaultTTL = time.Duration(*config.CacheTTL) * time.Second
+	}
+	route.CachePolicy = &cachePolicy
+
+	if len(config.BackendTimeout) > 0 {
+		timeout, err := jiffy.DurationOf(config.BackendTimeout)
+		if err != nil {
+			return nil, err
+		}
+		route.BackendTimeout = timeout
+	}
+	if len(config.CacheableMethods) > 0 {
+		route.CacheableMethods = config.CacheableMethods
+	}
+	return route, nil
+}
+
+// globRegexp compiles a glob where * matches any characters and ? matches a single character,
+// into a regular expression matching the whole string.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// applyBreakerConfig override the thresholds of the policy with the ones set in the configuration.
+func applyBreakerConfig(policy *BreakerPolicy, config *BreakerConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MaxRequests > 0 {
+		policy.MaxRequests = config.MaxRequests
+	}
+	if len(config.Interval) > 0 {
+		interval, err := jiffy.DurationOf(config.Interval)
+		if err != nil {
+			return err
+		}
+		policy.Interval = interval
+	}
+	if len(config.Timeout) > 0 {
+		timeout, err := jiffy.DurationOf(config.Timeout)
+		if err != nil {
+			return err
+		}
+		policy.Timeout = timeout
+	}
+	if config.FailureRate > 0 {
+		policy.FailureRate = config.FailureRate
+	}
+	if config.ConsecutiveFail > 0 {
+		policy.ConsecutiveFail = config.ConsecutiveFail
+	}
+	if config.MinRequests > 0 {
+		policy.MinRequests = config.MinRequests
+	}
+	if len(config.SlowCallDuration) > 0 {
+		duration, err := jiffy.DurationOf(config.SlowCallDuration)
+		if err != nil {
+			return err
+		}
+		policy.SlowCallDuration = duration
+	}
+	if config.SlowCallRate < 0 || config.SlowCallRate > 1 {
+		return fmt.Errorf("slow call rate %v is not between 0 and 1", config.SlowCallRate)
+	}
+	if config.SlowCallRate > 0 {
+		policy.SlowCallRate = config.SlowCallRate
+	}
+	if config.SlowCallMinRequests > 0 {
+		policy.SlowCallMinRequests = config.SlowCallMinRequests
+	}
+	if len(config.Window) > 0 {
+		switch config.Window {
+		case BreakerWindowFixed, BreakerWindowCount, BreakerWindowTime:
+			policy.Window = config.Window
+		default:
+			return fmt.Errorf("unknown breaker window \"%s\"", config.Window)
+		}
+	}
+	if config.WindowSize > 0 {
+		policy.WindowSize = config.WindowSize
+	}
+	if config.WindowBuckets > 0 {
+		policy.WindowBuckets = config.WindowBuckets
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRouteTable(t *testing.T) {
+	routes := `[
+		{"name": "search", "prefix": "/search", "backend-timeout": "2 seconds", "cache-ttl": 0,
+		 "breaker": {"consecutive-fail": 1, "interval": "1 minute", "timeout": "5 seconds"},
+		 "write-breaker": {"consecutive-fail": 7}},
+		{"regex": "^/static/.*\\.(css|js)$", "cache-ttl": 3600, "cacheable-methods": ["GET", "HEAD"]},
+		{"glob": "/api/*/detail"}
+	]`
+	table, err := ParseRouteTable(routes, NewDefaultRoutePolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		path  string
+		route string
+	}{
+		{"/search?q=shoes", "search"},
+		{"/searching", "search"},
+		{"/static/site.css", "^/static/.*\\.(css|js)$"},
+		{"/static/logo.png", RouteDefault},
+		{"/api/products/detail", "/api/*/detail"},
+		{"/api/products/detail/more", RouteDefault},
+		{"/", RouteDefault},
+	}
+	for _, td := range testData {
+		if route := table.Match(httptest.NewRequest("GET", td.path, nil)); route.Name != td.route {
+			t.Errorf("Expect %s to match route %s but %s", td.path, td.route, route.Name)
+		}
+	}
+
+	search := table.Routes[0]
+	if search.BackendTimeout != 2*time.Second || search.CachePolicy.DefaultTTL != 0 ||
+		search.Breaker.ConsecutiveFail != 1 || search.Breaker.Interval != time.Minute || search.Breaker.Timeout != 5*time.Second {
+		t.Errorf("Unexpected search policy %v", search)
+	}
+	if search.Breaker.MaxRequests != 1 || search.Breaker.FailureRate != Config.GetFloat(FailureRate) {
+		t.Errorf("Expect unset breaker thresholds to take the default but %v", search.Breaker)
+	}
+	if write := search.BreakerPolicy("POST"); write.ConsecutiveFail != 7 || write.Timeout != 10*time.Second || search.BreakerPolicy("GET") != search.Breaker {
+		t.Errorf("Unexpected search write breaker %v", write)
+	}
+	static := table.Routes[1]
+	if static.CachePolicy.DefaultTTL != time.Hour || !static.Cacheable("HEAD") || static.Cacheable("POST") {
+		t.Errorf("Unexpected static policy %v", static)
+	}
+	if table.Default.CachePolicy.DefaultTTL != 60*time.Second || table.Default.BackendTimeout != 15*time.Second {
+		t.Errorf("Expect default policy to take the global configuration but %v", table.Default)
+	}
+
+	for _, invalid := range []string{
+		`{"prefix": "/"}`,
+		`[{"name": "nothing to match"}]`,
+		`[{"prefix": "/", "glob": "/*"}]`,
+		`[{"regex": "("}]`,
+		`[{"prefix": "/", "backend-timeout": "soon"}]`,
+		`[{"prefix": "/", "breaker": {"slow-call-rate": 1.5}}]`,
+		`[{"prefix": "/", "breaker": {"slow-call-rate": -0.5}}]`,
+	} {
+		if _, err := ParseRouteTable(invalid, NewDefaultRoutePolicy()); err == nil {
+			t.Errorf("Expect error for %s", invalid)
+		}
+	}
+}
+
+func TestRoutePolicies(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body of " + req.Method + " " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[RoutePolicies] = `[
+		{"prefix": "/slow", "backend-timeout": "100 milliseconds"},
+		{"prefix": "/nocache", "cache-ttl": 0},
+		{"prefix": "/head", "cacheable-methods": ["GET", "HEAD"]},
+		{"prefix": "/strict", "breaker": {"consecutive-fail": 1}}
+	]`
+	defer func() {
+		Config[RoutePolicies] = ""
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+	if len(handler.Routes.Routes) != 4 {
+		t.Fatalf("Expect 4 routes but %d", len(handler.Routes.Routes))
+	}
+
+	resp := MakeCall("GET", "/slow", t, handler)
+	if resp.Code != http.StatusGatewayTimeout || resp.Header().Get("X-Retter") != "no-cache" {
+		t.Errorf("Expect backend timeout but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+
+	MakeCall("GET", "/nocache", t, handler)
+	MakeCall("GET", "/cached", t, handler)
+	if handler.Cache.Get("/nocache", false, 0) != nil || handler.Cache.Get("/cached", false, 0) == nil {
+		t.Errorf("Expect only /cached in cache")
+	}
+
+	MakeCall("HEAD", "/head", t, handler)
+	MakeCall("HEAD", "/other", t, handler)
+	if handler.Cache.Get("HEAD /head", false, 0) == nil || handler.Cache.Get("HEAD /other", false, 0) != nil {
+		t.Errorf("Expect only HEAD /head in cache")
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	resp = MakeCall("HEAD", "/head", t, handler)
+	if resp.Code != http.StatusOK || resp.Header().Get("X-Retter") != "cache" {
+		t.Errorf("Expect HEAD to be served from cache but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+	for i := 0; i < 2; i++ {
+		MakeCall("GET", "/strict", t, handler)
+		MakeCall("GET", "/lenient", t, handler)
+	}
+	if resp := MakeCall("GET", "/strict", t, handler); resp.Header().Get("X-Circuit") != "OPEN; level=key" {
+		t.Errorf("Expect strict breaker to open after 2 failures but %s", resp.Header().Get("X-Circuit"))
+	}
+	if resp := MakeCall("GET", "/lenient", t, handler); resp.Header().Get("X-Circuit") != "CLOSED" {
+		t.Errorf("Expect default breaker to stay closed but %s", resp.Header().Get("X-Circuit"))
+	}
+}
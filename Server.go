@@ -21,8 +21,8 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
-	"github.com/hyperjumptech/jiffy"
 	"github.com/hyperjumptech/retter/cache"
 	"github.com/sirupsen/logrus"
 	"github.com/sony/gobreaker"
@@ -30,16 +30,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"reflect"
-	"runtime"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	// RetterStatusBackendTimeout is a custom HTTP response code if
+	// RetterStatusBackendTimeout is the HTTP response code if
 	// the http client timed out while trying to call the backend server
-	RetterStatusBackendTimeout = 1000
+	RetterStatusBackendTimeout = http.StatusGatewayTimeout
 )
 
 var (
@@ -48,22 +49,8 @@ var (
 		"file":   "Server.go",
 	})
 
-	lastKnownSuccess = make(map[string]HTTPTransaction)
-
 	// ServerStarTime is a variable to store server start time.
 	ServerStarTime time.Time
-
-	// RequestCount to store total served request, with exception to /health health check path.
-	RequestCount uint16
-
-	// TotalResponseTime is a total response time in millisecond been recorded by this RETTER server
-	TotalResponseTime uint64
-
-	// SlowestResponseTime is the number of milliseconds of the slowest response time.
-	SlowestResponseTime uint64
-
-	// FastestResponseTime is the number of milliseconds of the fastest response time.
-	FastestResponseTime uint64
 )
 
 func init() {
@@ -71,132 +58,360 @@ func init() {
 }
 
 // NewRetterHTTPHandler create new http.Handler for this Retter server
-func NewRetterHTTPHandler() http.Handler {
-	return &RetterHTTPHandler{
-		BackendBaseURL: Config.GetString(BackendURL),
+func NewRetterHTTPHandler() *RetterHTTPHandler {
+	dir := Config.GetString(CacheDiskDir)
+	handler := &RetterHTTPHandler{
+		LastKnownMaxAge: Config.GetDuration(LastKnownMaxAge),
+		CacheFirst:      Config.GetBoolean(CacheFirst),
+		Tags:            NewTagIndex(tagHeaders()),
+		Stats:           &RequestStats{},
+		varyIndex:       newVaryIndex(),
+	}
+	handler.Cache = newCacheStore(cache.Options{
+		EvictionPolicy:  Config.GetString(CacheEvictPolicy),
+		MaxEntries:      Config.GetInt(CacheMaxEntries),
+		MaxBytes:        int64(Config.GetInt(CacheMaxBytes)),
+		Dir:             filepath.Join(dir, "cache"),
+		Codec:           &TransactionCodec{},
+		CompactInterval: Config.GetDuration(CacheDiskCompact),
+		OnEvict:         handler.untagEvicted,
+	})
+	handler.LastKnownSuccess = newCacheStore(cache.Options{
+		EvictionPolicy:  Config.GetString(LastKnownEvictPolicy),
+		MaxEntries:      Config.GetInt(LastKnownMaxEntries),
+		MaxBytes:        int64(Config.GetInt(LastKnownMaxBytes)),
+		Dir:             filepath.Join(dir, "lastknown"),
+		Codec:           &TransactionCodec{},
+		CompactInterval: Config.GetDuration(CacheDiskCompact),
+		OnEvict:         handler.untagEvicted,
+	})
+	routes, err := NewRouteTable()
+	if err != nil {
+		serverLog.Errorf("Can not load route policies, fallback to the default policy. Got %s", err.Error())
+		routes = &RouteTable{Default: NewDefaultRoutePolicy()}
 	}
+	handler.Routes = routes
+	upstreams, err := NewUpstreamRouter()
+	if err != nil {
+		serverLog.Errorf("Can not load upstreams, fallback to backend.baseurl only. Got %s", err.Error())
+		defaultUpstream, _ := NewDefaultUpstream(BalanceRoundRobin)
+		upstreams = &UpstreamRouter{Default: defaultUpstream}
+	}
+	handler.Upstreams = upstreams
+	handler.Retry = NewRetryPolicy()
+	handler.Hedger = NewHedger()
+	if handler.HealthChecker = NewHealthChecker(upstreams.All()); handler.HealthChecker != nil {
+		handler.HealthChecker.Start()
+	}
+	handler.indexStoredTags()
+	if Config.GetBoolean(CoalesceEnabled) {
+		handler.Coalescer = NewCoalescer(Config.GetDuration(CoalesceMaxWait))
+	}
+	return handler
+}
+
+// newCacheStore creates the configured cache store, or a memory store if it can not be created.
+func newCacheStore(opts cache.Options) cache.Store {
+	storeName := Config.GetString(CacheStore)
+	store, err := cache.NewStore(storeName, opts)
+	if err != nil {
+		serverLog.Errorf("Can not create cache store \"%s\", fallback to memory store. Got %s", storeName, err.Error())
+		return cache.NewMemoryStoreWithOptions(opts)
+	}
+	return store
 }
 
 // RetterHTTPHandler an implementation of http.Handler
 type RetterHTTPHandler struct {
-	BackendBaseURL string
+	// Upstreams pick the backend of each request, each with its own breakers and cache namespace.
+	Upstreams *UpstreamRouter
+
+	// Retry decide whether and when a failed backend call is tried again.
+	Retry *RetryPolicy
+
+	// Hedger fire a second backend call for the slow ones.
+	Hedger *Hedger
+
+	// HealthChecker probe the upstream instances in the background, nil if no upstream has a health path.
+	HealthChecker *HealthChecker
+
+	// Cache is the storage where successful backend responses are cached.
+	Cache cache.Store
+
+	// LastKnownSuccess is the storage of the last successful backend response of each key.
+	// It's bounded independently from the Cache, and its responses expire after LastKnownMaxAge.
+	LastKnownSuccess cache.Store
+
+	// LastKnownMaxAge is how long a last known success response may be served, zero means forever.
+	LastKnownMaxAge time.Duration
+
+	// Routes pick the breaker thresholds, cache policy and backend timeout of each request.
+	Routes *RouteTable
+
+	// CacheFirst when true, fresh cached response is served without calling the backend.
+	CacheFirst bool
+
+	// Coalescer collapse concurrent identical requests into a single backend call, nil if disabled.
+	Coalescer *Coalescer
+
+	// Tags index the stored responses by the tags the backend attached to them.
+	Tags *TagIndex
+
+	// Stats keep the number of served requests and their response times, with exception to /health.
+	Stats *RequestStats
+
+	// varyIndex keep the request headers the cached response of each key varies by.
+	varyIndex cache.Store
+
+	// revalidating is the set of cache keys being refreshed in the background.
+	revalidating sync.Map
+
+	// background wait for the background refreshes to finish.
+	background sync.WaitGroup
+}
+
+// Close release the resources held by this handler, such as the persistent cache stores.
+func (rhh *RetterHTTPHandler) Close() {
+	if rhh.HealthChecker != nil {
+		rhh.HealthChecker.Close()
+	}
+	rhh.background.Wait()
+	for _, store := range []cache.Store{rhh.Cache, rhh.LastKnownSuccess, rhh.varyIndex} {
+		if err := store.Close(); err != nil {
+			serverLog.Errorf("Error while closing cache store. got %s", err.Error())
+		}
+	}
 }
 
 // ServeHTTP is the handling method of incoming HTTP request and response
 func (rhh *RetterHTTPHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	if strings.ToUpper(req.Method) == "GET" && req.URL.Path == "/health" {
-		res.Header().Add("Content-Type", "application/json")
-		res.WriteHeader(http.StatusOK)
-
-		uptime := jiffy.DescribeDuration(time.Since(ServerStarTime), jiffy.NewWant())
-		cacheCount := cache.CacheSize()
-		timerCount := cache.TimerSize()
-		breakerCount := len(PathBreakers)
-
-		AverageResponseTime := float64(TotalResponseTime) / float64(RequestCount)
-
-		memStat := &runtime.MemStats{}
-		runtime.ReadMemStats(memStat)
-
-		body := fmt.Sprintf("{\"status\":\"OK\", "+
-			"\"server-uptime\": \"%s\", "+
-			"\"cache-count\":%d, "+
-			"\"ttl-timer-count\":%d, "+
-			"\"breaker-count\":%d, "+
-			"\"total-request-served\":%d, "+
-			"\"total-response-time-ms\":%d, "+
-			"\"average-response-time-ms\":%f,"+
-			"\"slowest-response-time-ms\":%d,"+
-			"\"fastest-response-time-ms\":%d,"+
-			"\"memory\":{"+
-			"\"sys-memory-byte\":%d, "+
-			"\"alloc-memory-byte\":%d, "+
-			"\"total-alloc-memory-byte\":%d"+
-			"}}", uptime, cacheCount, timerCount, breakerCount,
-			RequestCount, TotalResponseTime, AverageResponseTime,
-			SlowestResponseTime, FastestResponseTime,
-			memStat.Sys, memStat.Alloc, memStat.TotalAlloc)
-		res.Write([]byte(body))
+		rhh.ServeHealth(res)
 		return
 	}
 
-	RequestCount++
-	StartTime := time.Now()
-
+	startTime := time.Now()
 	defer func() {
-		processDuration := time.Since(StartTime)
-		msDuration := uint64(processDuration / time.Millisecond)
-		TotalResponseTime += msDuration
-		if reflect.ValueOf(SlowestResponseTime).IsZero() {
-			SlowestResponseTime = msDuration
-		} else {
-			if SlowestResponseTime < msDuration {
-				SlowestResponseTime = msDuration
+		rhh.Stats.Record(time.Since(startTime))
+	}()
+
+	route := rhh.Routes.Match(req)
+	if !route.Cacheable(req.Method) {
+		rhh.serveUncached(res, req, route)
+		return
+	}
+
+	breaker := rhh.GetBreakerForRequest(req)
+	if rhh.CacheFirst {
+		if val := rhh.Cache.Get(rhh.getCacheKey(req), false, 0); val != nil {
+			tx := val.(HTTPTransaction)
+			staleness := StalenessOf(tx, time.Now())
+			if staleness < 0 {
+				ServeTransaction(res, req, tx, "cache-hit", breaker.Circuit())
+				return
 			}
-		}
-		if reflect.ValueOf(FastestResponseTime).IsZero() {
-			FastestResponseTime = msDuration
-		} else {
-			if FastestResponseTime > msDuration {
-				FastestResponseTime = msDuration
+			if staleness <= tx.Freshness().StaleWhileRevalidate {
+				res.Header().Set("Warning", `110 - "Response is Stale"`)
+				ServeTransaction(res, req, tx, "stale", breaker.Circuit())
+				rhh.revalidate(req, breaker)
+				return
 			}
 		}
-	}()
+	}
 
-	if strings.ToUpper(req.Method) != "GET" {
-		recorder := httptest.NewRecorder()
-		Execute(15*time.Second, rhh.BackendBaseURL, recorder, req)
-		ReturnRecorder(req, recorder, res)
+	if breaker.State() == gobreaker.StateOpen {
+		rhh.ServeFailedProcess(http.StatusBadGateway, res, req, breaker.Circuit())
+		return
+	}
+	// every instance is down according to the health checker, don't wait for the call to fail.
+	if !rhh.Upstreams.Match(req).Up() {
+		rhh.ServeFailedProcess(http.StatusServiceUnavailable, res, req, breaker.Circuit())
+		return
+	}
+	tx, err := rhh.fetchAndStore(req, breaker)
+	if err != nil {
+		code := http.StatusBadGateway
+		if err == ErrCoalesceTimeout {
+			code = http.StatusGatewayTimeout
+		} else if tx != nil && tx.Response().Code >= 400 {
+			// a success response counted as failure, such as a maintenance page, stays a bad gateway
+			code = tx.Response().Code
+		}
+		rhh.ServeFailedProcess(code, res, req, breaker.Circuit())
 		return
 	}
+	ReturnRecorder(req, tx.Response(), res)
+}
 
-	breaker := GetBreakerForRequest(req)
-	switch breaker.State() {
-	case gobreaker.StateOpen:
-		ServeFailedProcess(http.StatusBadGateway, res, req, breaker.State())
-	default:
-		l := serverLog.WithFields(logrus.Fields{
-			"Method": req.Method,
-		})
-		key := getKey(req)
-		timeStart := time.Now()
-		val, err := breaker.Execute(func() (interface{}, error) {
-			l.Debugf("PATH:%s RAWQUERY:%s", req.URL.Path, req.URL.RawQuery)
+// serveUncached forward a request that is not cached, such as POST, to the backend through its breaker.
+// Its response is never stored, so when the breaker is open the request fails fast instead of being
+// served from cache, with Retry-After telling the client when the backend may be called again.
+func (rhh *RetterHTTPHandler) serveUncached(res http.ResponseWriter, req *http.Request, route *RoutePolicy) {
+	breaker := rhh.GetBreakerForRequest(req)
+	upstream := rhh.Upstreams.Match(req)
+	val, err := breaker.Execute(func() (interface{}, error) {
+		recorder := rhh.Retry.Do(req, func(attempt *http.Request) *httptest.ResponseRecorder {
 			recorder := httptest.NewRecorder()
-			Execute(15*time.Second, rhh.BackendBaseURL, recorder, req)
-			if recorder.Result().StatusCode >= 500 {
-				return recorder, fmt.Errorf("response code %d", recorder.Result().StatusCode)
-			}
-			return recorder, nil
+			upstream.Execute(route.BackendTimeout, route.Failure, recorder, attempt)
+			return recorder
 		})
-		timeEnd := time.Now()
-		recorder := val.(*httptest.ResponseRecorder)
-		if err != nil {
-			// logrus.Errorf("Error in breaker execution. got %s - code : %d", err.Error(), recorder.Result().StatusCode)
-			ServeFailedProcess(recorder.Result().StatusCode, res, req, breaker.State())
-		} else {
-			if len(recorder.Header().Get("X-Circuit")) == 0 {
-				recorder.Header().Set("X-Circuit", getGoBreakerString(breaker.State()))
-			}
-			if len(recorder.Header().Get("X-Retter")) == 0 {
-				recorder.Header().Set("X-Retter", "backend")
-			}
-			ReturnRecorder(req, recorder, res)
-			tx := &DefaultHTTPTransaction{
-				TimeStart: timeStart,
-				TimeEnd:   timeEnd,
-				Rec:       req,
-				Res:       recorder,
-			}
-			cache.Store(key, tx, time.Duration(Config.GetInt(CacheTTL))*time.Second)
-			lastKnownSuccess[key] = &DefaultHTTPTransaction{
-				TimeStart: timeStart,
-				TimeEnd:   timeEnd,
-				Rec:       req,
-				Res:       recorder,
-			}
+		// a call cancelled by its client says nothing about the backend.
+		if req.Context().Err() == context.Canceled {
+			return recorder, errNotCounted
+		}
+		if err := route.Failure.Classify(recorder); err != nil {
+			return recorder, err
+		}
+		return recorder, nil
+	})
+	if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+		// the whole seconds until the open breaker turns half-open
+		retryAfter := (breaker.OpenRemaining() + time.Second - 1) / time.Second
+		if retryAfter <= 0 {
+			// refused while half-open, try again shortly
+			retryAfter = 1
 		}
+		res.Header().Set("X-Circuit", breaker.Circuit())
+		res.Header().Set("X-Retter", "no-cache")
+		res.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte("Backend is down, please try again in few minutes"))
+		return
 	}
+	recorder := val.(*httptest.ResponseRecorder)
+	recorder.Header().Set("X-Circuit", breaker.Circuit())
+	ReturnRecorder(req, recorder, res)
+}
+
+// fetchAndStore fetch the request from backend and store the successful response.
+// Concurrent identical requests are coalesced into a single backend call, when enabled.
+// Requests carrying credentials are never coalesced, and a response that may not be stored is not shared.
+func (rhh *RetterHTTPHandler) fetchAndStore(req *http.Request, breaker *BreakerChain) (*DefaultHTTPTransaction, error) {
+	fn := func() (*DefaultHTTPTransaction, error) {
+		tx, err := rhh.fetch(req, breaker)
+		if err == nil {
+			rhh.storeTransaction(tx)
+		}
+		return tx, err
+	}
+	if rhh.Coalescer == nil || hasCredentials(req) {
+		return fn()
+	}
+	policy := rhh.Routes.Match(req).CachePolicy
+	tx, shared, err := rhh.Coalescer.Do(rhh.getCacheKey(req), fn, func(tx *DefaultHTTPTransaction) bool {
+		return policy.Storable(tx.Request(), tx.Response().Header())
+	})
+	if shared {
+		serverLog.Tracef("%s shared an in-flight backend call", req.URL.Path)
+	}
+	return tx, err
+}
+
+// fetch call the backend through the breaker. The returned transaction is nil if the breaker refused the call,
+// as it just opened or too many calls while half-open.
+func (rhh *RetterHTTPHandler) fetch(req *http.Request, breaker *BreakerChain) (*DefaultHTTPTransaction, error) {
+	l := serverLog.WithFields(logrus.Fields{
+		"Method": req.Method,
+	})
+	stored := rhh.storedTransaction(req)
+	route := rhh.Routes.Match(req)
+	upstream := rhh.Upstreams.Match(req)
+	timeStart := time.Now()
+	val, err := breaker.Execute(func() (interface{}, error) {
+		l.Debugf("PATH:%s RAWQUERY:%s", req.URL.Path, req.URL.RawQuery)
+		// the retries and hedges are inside the breaker, so they count as a single outcome.
+		recorder := rhh.Retry.Do(conditionalRequest(req, stored), func(attempt *http.Request) *httptest.ResponseRecorder {
+			return rhh.Hedger.Do(attempt, route.Failure, func(call *http.Request) *httptest.ResponseRecorder {
+				recorder := httptest.NewRecorder()
+				upstream.Execute(route.BackendTimeout, route.Failure, recorder, call)
+				return recorder
+			})
+		})
+		if err := route.Failure.Classify(recorder); err != nil {
+			return recorder, err
+		}
+		if recorder.Code == http.StatusNotModified && stored != nil {
+			l.Debugf("PATH:%s RAWQUERY:%s is not modified, refreshing the stored response", req.URL.Path, req.URL.RawQuery)
+			recorder = revalidated(stored, recorder)
+			recorder.Header().Set("X-Retter", "revalidated")
+		}
+		return recorder, nil
+	})
+	timeEnd := time.Now()
+	if val == nil {
+		return nil, err
+	}
+	recorder := val.(*httptest.ResponseRecorder)
+	if err == nil {
+		if len(recorder.Header().Get("X-Circuit")) == 0 {
+			recorder.Header().Set("X-Circuit", breaker.Circuit())
+		}
+		if len(recorder.Header().Get("X-Retter")) == 0 {
+			recorder.Header().Set("X-Retter", "backend")
+		}
+	}
+	return &DefaultHTTPTransaction{
+		TimeStart: timeStart,
+		TimeEnd:   timeEnd,
+		Rec:       req,
+		Res:       recorder,
+	}, err
+}
+
+// storedTransaction return the stored response of the request to be revalidated,
+// either from the cache, even if it's stale, or the last known success.
+func (rhh *RetterHTTPHandler) storedTransaction(req *http.Request) HTTPTransaction {
+	key := rhh.getCacheKey(req)
+	if val := rhh.Cache.Get(key, false, 0); val != nil {
+		return val.(HTTPTransaction)
+	}
+	if val := rhh.LastKnownSuccess.Get(key, false, 0); val != nil {
+		return val.(HTTPTransaction)
+	}
+	return nil
+}
+
+// revalidate refresh the cached response of the request in the background.
+// Only one refresh for each cache key is running at a time.
+func (rhh *RetterHTTPHandler) revalidate(req *http.Request, breaker *BreakerChain) {
+	key := rhh.getCacheKey(req)
+	if _, running := rhh.revalidating.LoadOrStore(key, true); running {
+		return
+	}
+	backgroundReq := req.Clone(context.Background())
+	rhh.background.Add(1)
+	go func() {
+		defer rhh.background.Done()
+		defer rhh.revalidating.Delete(key)
+
+		if breaker.State() == gobreaker.StateOpen || !rhh.Upstreams.Match(backgroundReq).Up() {
+			return
+		}
+		if _, err := rhh.fetchAndStore(backgroundReq, breaker); err != nil {
+			serverLog.Debugf("background refresh of %s failed. got %s", key, err.Error())
+		}
+	}()
+}
+
+// storeTransaction store a successful backend transaction into the cache and as the last known success,
+// as long as the cache policy of its route allows it. The transaction is kept in the cache while it's fresh,
+// and as long as it may still be served stale.
+func (rhh *RetterHTTPHandler) storeTransaction(tx *DefaultHTTPTransaction) {
+	header := tx.Response().Header()
+	policy := rhh.Routes.Match(tx.Request()).CachePolicy
+	if !policy.Storable(tx.Request(), header) {
+		serverLog.Debugf("response of %s is not storable", tx.Request().URL.Path)
+		return
+	}
+	key := rhh.rememberVary(tx.Request(), header)
+	tx.Fresh = policy.Freshness(header, time.Now())
+	if retention := tx.Fresh.Retention(); retention > 0 {
+		rhh.Cache.Set(key, tx, retention)
+	} else {
+		rhh.Cache.Delete(key)
+	}
+	rhh.LastKnownSuccess.Set(key, tx, rhh.LastKnownMaxAge)
+	rhh.Tags.Tag(key, header)
 }
 
 func getGoBreakerString(state gobreaker.State) string {
@@ -216,68 +431,89 @@ func getGoBreakerString(state gobreaker.State) string {
 // into history of last known response that was successful
 // If no cache or last successful response were found, it will then emit
 // 5xx error
-func ServeFailedProcess(erroneousResponseCode int, res http.ResponseWriter, req *http.Request, state gobreaker.State) {
-	key := getKey(req)
-	val := cache.Get(key, false, 0)
-	if val == nil {
-		if lastSuccessTx, ok := lastKnownSuccess[key]; ok {
-			recorder := lastSuccessTx.Response()
-
-			recorder.Header().Del("X-Circuit")
-			recorder.Header().Set("X-Circuit", getGoBreakerString(state))
-			recorder.Header().Del("X-Retter")
-			recorder.Header().Set("X-Retter", "last-known-success")
-			ReturnRecorder(req, recorder, res)
+func (rhh *RetterHTTPHandler) ServeFailedProcess(erroneousResponseCode int, res http.ResponseWriter, req *http.Request, circuit string) {
+	key := rhh.getCacheKey(req)
+	if val := rhh.Cache.Get(key, false, 0); val != nil {
+		cachedTx := val.(HTTPTransaction)
+		staleness := StalenessOf(cachedTx, time.Now())
+		if staleness < 0 {
+			ServeTransaction(res, req, cachedTx, "cache", circuit)
+			return
+		}
+		if staleness <= cachedTx.Freshness().StaleIfError {
+			res.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			ServeTransaction(res, req, cachedTx, "stale", circuit)
+			return
+		}
+	}
+	if lastSuccess := rhh.LastKnownSuccess.Get(key, false, 0); lastSuccess != nil {
+		lastTx := lastSuccess.(HTTPTransaction)
+		fresh := lastTx.Freshness()
+		switch {
+		case !fresh.StrictStaleIfError:
+			ServeTransaction(res, req, lastTx, "last-known-success", circuit)
 			serverLog.Debugf("returned from last success for key %s", key)
-		} else {
-			res.Header().Del("X-Circuit")
-			res.Header().Set("X-Circuit", getGoBreakerString(state))
-			res.Header().Del("X-Retter")
-			res.Header().Set("X-Retter", "no-cache")
-			res.WriteHeader(erroneousResponseCode)
-			res.Write([]byte("Backend is down, please try again in few minutes"))
+			return
+		case StalenessOf(lastTx, time.Now()) <= fresh.StaleIfError:
+			// no longer in cache, but still within the backend's stale-if-error
+			res.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			ServeTransaction(res, req, lastTx, "stale", circuit)
+			return
+		default:
+			serverLog.Debugf("last success for key %s is past the stale-if-error of the backend", key)
 		}
-		return
 	}
-	cachedTx := val.(HTTPTransaction)
+	res.Header().Set("X-Circuit", circuit)
+	res.Header().Set("X-Retter", "no-cache")
+	res.WriteHeader(erroneousResponseCode)
+	res.Write([]byte("Backend is down, please try again in few minutes"))
+}
 
-	cachedTx.Response().Header().Del("X-Circuit")
-	cachedTx.Response().Header().Set("X-Circuit", getGoBreakerString(state))
-	cachedTx.Response().Header().Del("X-Retter")
-	cachedTx.Response().Header().Set("X-Retter", "cache")
+// ServeTransaction write a stored transaction as the response. The response is marked with
+// X-Retter header telling where it comes from, X-Circuit header and its Age.
+// The stored transaction itself is not modified, so it is safe to be served concurrently.
+func ServeTransaction(res http.ResponseWriter, req *http.Request, tx HTTPTransaction, source string, circuit string) {
+	res.Header().Set("X-Circuit", circuit)
+	res.Header().Set("X-Retter", source)
+	res.Header().Set("Age", strconv.FormatInt(int64(AgeOf(tx, time.Now())/time.Second), 10))
+	ReturnRecorder(req, tx.Response(), res)
+}
 
-	ReturnRecorder(req, cachedTx.Response(), res)
+// copyHeader copy all recorded headers into the writer, except those already set in the writer.
+func copyHeader(recorded http.Header, writer http.ResponseWriter) {
+	preset := make(map[string]bool)
+	for k := range writer.Header() {
+		preset[k] = true
+	}
+	for k, v := range recorded {
+		if preset[k] {
+			continue
+		}
+		for _, val := range v {
+			writer.Header().Add(k, val)
+		}
+	}
 }
 
 // ReturnCompressedRecorder will return the recorder IF the rrequest is asking for compressed
-// Content-Encoding using Accept-Encoding: gzip
+// Content-Encoding using Accept-Encoding: gzip.
+// Headers already set in the writer take precedence over the recorded ones.
 func ReturnCompressedRecorder(recorder *httptest.ResponseRecorder, writer http.ResponseWriter) {
 	bodyBytes := recorder.Body.Bytes()
 
-	containsContentType := false
-
 	// write the rest of the headers.
-	for key, v := range recorder.Header() {
-		for _, vv := range v {
-			if strings.ToLower(key) == "content-type" {
-				containsContentType = true
-				logrus.Tracef("%s: %s already exist.", key, vv)
-			}
-			writer.Header().Set(key, vv)
-			//logrus.Infof("GZIP Header %s : %s", key, vv)
-		}
-	}
+	copyHeader(recorder.Header(), writer)
 
 	// If its non 2xx we dont compress it.
-	if recorder.Result().StatusCode < 200 || recorder.Result().StatusCode >= 300 {
+	if recorder.Code < 200 || recorder.Code >= 300 {
 		// write the result.
-		writer.WriteHeader(recorder.Result().StatusCode)
+		writer.WriteHeader(recorder.Code)
 		// write the body after write header so golang http will not temper to the response code
 		writer.Write(bodyBytes)
 		return
 	}
 
-	if !containsContentType {
+	if len(writer.Header().Get("Content-Type")) == 0 {
 		ctype := http.DetectContentType(bodyBytes)
 		logrus.Tracef("Content-Type not exist. Assigning one with Content-Type: %s. ", ctype)
 		writer.Header().Set("Content-Type", ctype)
@@ -286,8 +522,9 @@ func ReturnCompressedRecorder(recorder *httptest.ResponseRecorder, writer http.R
 	// if the body size is above minimum size zip them.
 	if len(bodyBytes) > 300 {
 
-		// add header for gzip content encoding
+		// add header for gzip content encoding, the length is no longer the recorded one.
 		writer.Header().Set("Content-Encoding", "gzip")
+		writer.Header().Del("Content-Length")
 		// write the result.
 		writer.WriteHeader(recorder.Code)
 
@@ -316,30 +553,28 @@ func ReturnCompressedRecorder(recorder *httptest.ResponseRecorder, writer http.R
 	}
 }
 
-// ReturnRecorder will write recorded response into response writer
+// ReturnRecorder will write recorded response into response writer.
+// Headers already set in the writer take precedence over the recorded ones.
+// If the request is a conditional request satisfied by the recorded response, 304 Not Modified is written instead.
 func ReturnRecorder(request *http.Request, recorder *httptest.ResponseRecorder, writer http.ResponseWriter) {
 
+	if recorder.Code == http.StatusOK && NotModified(request, recorder.Header()) {
+		ReturnNotModified(recorder, writer)
+		return
+	}
+
 	if strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
 		ReturnCompressedRecorder(recorder, writer)
+		return
 	}
 
 	// First we write the headers
-	for k, v := range recorder.Header() {
-		for _, val := range v {
-			writer.Header().Add(k, val)
-			//logrus.Infof("Header %s : %s", k, val)
-		}
-	}
+	copyHeader(recorder.Header(), writer)
 	// Then we write the status code
-	writer.WriteHeader(recorder.Result().StatusCode)
-	// Them we write the body if exist
-	body, err := ioutil.ReadAll(recorder.Body)
-	if err != nil {
-		writer.Write([]byte(err.Error()))
-		writer.WriteHeader(http.StatusBadGateway)
-		return
-	}
-	writer.Write(body)
+	writer.WriteHeader(recorder.Code)
+	// Them we write the body if exist, without draining the recorder
+	// as the same recorder might be served again from the cache.
+	writer.Write(recorder.Body.Bytes())
 }
 
 // Execute will do the actual HTTP call forwarding to the backend server.
@@ -356,10 +591,10 @@ func Execute(timeout time.Duration, targetURL string, res http.ResponseWriter, r
 		duration := time.Since(start)
 		serverLog.Tracef("[%s] %s took %d ms", req.Method, urlToCall, duration/time.Millisecond)
 	}()
-	request, err := http.NewRequest(req.Method, urlToCall, req.Body)
+	request, err := http.NewRequestWithContext(req.Context(), req.Method, urlToCall, req.Body)
 	if err != nil {
-		res.Write([]byte(err.Error()))
 		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
@@ -367,7 +602,7 @@ func Execute(timeout time.Duration, targetURL string, res http.ResponseWriter, r
 	// as we will handle this separately
 	for k, v := range req.Header {
 		for _, hv := range v {
-			if strings.ToLower(k) != "accept-encoding" && strings.Contains(strings.ToLower(hv), "gzip") {
+			if strings.ToLower(k) != "accept-encoding" || !strings.Contains(strings.ToLower(hv), "gzip") {
 				request.Header.Add(k, hv)
 			}
 		}
@@ -378,13 +613,13 @@ func Execute(timeout time.Duration, targetURL string, res http.ResponseWriter, r
 	if err != nil {
 		if urlErr, yes := err.(*url.Error); yes {
 			if urlErr.Timeout() {
-				res.Write([]byte(err.Error()))
 				res.WriteHeader(RetterStatusBackendTimeout)
+				res.Write([]byte(err.Error()))
 				return
 			}
 		}
-		res.Write([]byte(err.Error()))
 		res.WriteHeader(http.StatusBadGateway)
+		res.Write([]byte(err.Error()))
 		return
 	}
 	defer response.Body.Close()
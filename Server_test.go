@@ -19,17 +19,23 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/hyperjumptech/retter/cache"
 	"github.com/hyperjumptech/retter/test"
 	"go.uber.org/goleak"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestRetterHealthCheck(t *testing.T) {
 	handler := NewRetterHTTPHandler()
+	defer handler.Close()
 	resp := MakeCall("GET", "/health", t, handler)
 	if resp.Result().StatusCode != http.StatusOK {
 		t.Fatalf("Health check error")
@@ -39,8 +45,6 @@ func TestRetterHealthCheck(t *testing.T) {
 func TestNoCacheNoLastKnown(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	cache.Clear()
-
 	// lets start our dummy server
 	// lets start our dummy server
 	test.StartDummyServer("127.0.0.1:34251", false)
@@ -55,6 +59,7 @@ func TestNoCacheNoLastKnown(t *testing.T) {
 
 	Config[BackendURL] = "http://127.0.0.1:34251"
 	handler := NewRetterHTTPHandler()
+	defer handler.Close()
 
 	t.Logf("Making success call")
 	resp := MakeCall("GET", "/test/newpath", t, handler)
@@ -64,11 +69,28 @@ func TestNoCacheNoLastKnown(t *testing.T) {
 	}
 }
 
+func TestBackendTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	recorder := httptest.NewRecorder()
+	Execute(50*time.Millisecond, backend.URL, recorder, httptest.NewRequest("GET", "http://localhost/slow", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expect backend timeout answered with %d but %d", http.StatusGatewayTimeout, recorder.Code)
+	}
+}
+
 func BenchmarkRetterHTTPHandler_ServeHTTP(b *testing.B) {
 
 	Config[BackendURL] = "http://127.0.0.1:32415"
 
 	handler := NewRetterHTTPHandler()
+	defer handler.Close()
 
 	for n := 0; n < b.N; n++ {
 		r, err := http.NewRequest("GET", "http://localhost/some/path", nil)
@@ -88,8 +110,6 @@ func BenchmarkRetterHTTPHandler_ServeHTTP(b *testing.B) {
 func TestRetterHTTPHandler_ServeHTTP(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	cache.Clear()
-
 	// lets start our dummy server
 	test.StartDummyServer("127.0.0.1:34251", false)
 	t.Logf("Dummy server started")
@@ -100,6 +120,7 @@ func TestRetterHTTPHandler_ServeHTTP(t *testing.T) {
 
 	Config[BackendURL] = "http://127.0.0.1:34251"
 	handler := NewRetterHTTPHandler()
+	defer handler.Close()
 
 	t.Logf("Making dummy server always success")
 	test.FailProbability(0.0)
@@ -128,11 +149,278 @@ func TestRetterHTTPHandler_ServeHTTP(t *testing.T) {
 	// circuit breaker should return with cached success
 	t.Logf("Making fail call after circuit open")
 	resp = MakeCall("GET", "/test/path", t, handler)
-	if resp.Result().StatusCode != http.StatusOK || resp.Header().Get("X-Retter") != "cache" || resp.Header().Get("X-Circuit") != "OPEN" {
+	if resp.Result().StatusCode != http.StatusOK || resp.Header().Get("X-Retter") != "cache" || resp.Header().Get("X-Circuit") != "OPEN; level=key" {
 		t.Fatalf("Unexpected status code %d - retter header %s  - circuit %s", resp.Result().StatusCode, resp.Header().Get("X-Retter"), resp.Header().Get("X-Circuit"))
 	}
 }
 
+func TestBoundedCacheFlood(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	test.StartDummyServer("127.0.0.1:34251", false)
+	defer test.StopDummyServer()
+	test.FailProbability(0.0)
+	test.SetFastest(0, time.Millisecond)
+	defer test.SetFastest(0, time.Second)
+
+	Config[BackendURL] = "http://127.0.0.1:34251"
+	Config[CacheMaxEntries] = "50"
+	Config[CacheMaxBytes] = "200000"
+	defer func() {
+		Config[CacheMaxEntries] = "0"
+		Config[CacheMaxBytes] = "0"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 300; i++ {
+		r, err := http.NewRequest("GET", fmt.Sprintf("http://localhost/flood/path?unique=%d", i), nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Unexpected status code %d", resp.Code)
+		}
+		stats := handler.Cache.(cache.StatsReporter).Stats()
+		if stats.Entries > 50 || stats.Bytes > 200000 {
+			t.Fatalf("Cache exceeds its limit with %d entries and %d bytes", stats.Entries, stats.Bytes)
+		}
+	}
+	stats := handler.Cache.(cache.StatsReporter).Stats()
+	if stats.Evictions == 0 || stats.Bytes == 0 {
+		t.Fatalf("Expect cache to be full and evicting, got %d evictions and %d bytes", stats.Evictions, stats.Bytes)
+	}
+
+	resp := MakeCall("GET", "/health", t, handler)
+	health := &HealthStatus{}
+	if err := json.Unmarshal(resp.Body.Bytes(), health); err != nil {
+		t.Fatalf("Health check is not a valid json. got %s", err.Error())
+	}
+	if health.CacheEvictionCount != stats.Evictions {
+		t.Errorf("Expect health to report %d evictions but %d", stats.Evictions, health.CacheEvictionCount)
+	}
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	test.StartDummyServer("127.0.0.1:34251", false)
+	defer test.StopDummyServer()
+	test.FailProbability(0.0)
+	test.SetFastest(0, time.Millisecond)
+	defer test.SetFastest(0, time.Second)
+
+	Config[BackendURL] = "http://127.0.0.1:34251"
+	Config[CacheStore] = cache.DiskStoreName
+	Config[CacheDiskDir] = dir
+	defer func() {
+		Config[CacheStore] = cache.MemoryStoreName
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	handler := NewRetterHTTPHandler()
+	resp := MakeCall("GET", "/test/disk", t, handler)
+	if resp.Result().StatusCode != http.StatusOK || resp.Header().Get("X-Retter") != "backend" {
+		t.Fatalf("Unexpected status code %d - retter header %s", resp.Result().StatusCode, resp.Header().Get("X-Retter"))
+	}
+	body := resp.Body.String()
+	handler.Close()
+
+	test.FailProbability(1.0)
+	defer test.FailProbability(0.0)
+
+	handler = NewRetterHTTPHandler()
+	defer handler.Close()
+	resp = MakeCall("GET", "/test/disk", t, handler)
+	if resp.Result().StatusCode != http.StatusOK || resp.Header().Get("X-Retter") != "cache" {
+		t.Fatalf("Unexpected status code %d - retter header %s", resp.Result().StatusCode, resp.Header().Get("X-Retter"))
+	}
+	if resp.Body.String() != body {
+		t.Errorf("Expect the same body to be served from the disk cache")
+	}
+
+	handler.Cache.Clear()
+	resp = MakeCall("GET", "/test/disk", t, handler)
+	if resp.Result().StatusCode != http.StatusOK || resp.Header().Get("X-Retter") != "last-known-success" {
+		t.Fatalf("Unexpected status code %d - retter header %s", resp.Result().StatusCode, resp.Header().Get("X-Retter"))
+	}
+}
+
+func TestCacheFirst(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var backendCalls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&backendCalls, 1)
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("fresh from backend"))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheFirst] = "true"
+	Config[CacheTTL] = "2"
+	defer func() {
+		Config[CacheFirst] = "false"
+		Config[CacheTTL] = "60"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	resp := MakeCall("GET", "/cache/first", t, handler)
+	if resp.Header().Get("X-Retter") != "backend" {
+		t.Fatalf("Expect first call to reach the backend but %s", resp.Header().Get("X-Retter"))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	resp = MakeCall("GET", "/cache/first", t, handler)
+	if resp.Header().Get("X-Retter") != "cache-hit" || resp.Header().Get("Age") != "1" || resp.Body.String() != "fresh from backend" {
+		t.Fatalf("Expect cache hit with age 1 but %s with age %s", resp.Header().Get("X-Retter"), resp.Header().Get("Age"))
+	}
+	if atomic.LoadInt32(&backendCalls) != 1 {
+		t.Fatalf("Expect 1 backend call but %d", atomic.LoadInt32(&backendCalls))
+	}
+
+	time.Sleep(1000 * time.Millisecond)
+	resp = MakeCall("GET", "/cache/first", t, handler)
+	if resp.Header().Get("X-Retter") != "backend" || atomic.LoadInt32(&backendCalls) != 2 {
+		t.Fatalf("Expect expired entry to go to the backend but %s", resp.Header().Get("X-Retter"))
+	}
+}
+
+func TestStaleWhileRevalidateAndStaleIfError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var backendCalls, fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls := atomic.AddInt32(&backendCalls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.URL.Path == "/directive" {
+			res.Header().Set("Cache-Control", "max-age=1, stale-if-error=10")
+		}
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprintf(res, "response %d", calls)
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheFirst] = "true"
+	Config[CacheTTL] = "1"
+	Config[CacheStaleWhileRevalidate] = "10"
+	defer func() {
+		Config[CacheFirst] = "false"
+		Config[CacheTTL] = "60"
+		Config[CacheStaleWhileRevalidate] = "0"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	MakeCall("GET", "/swr", t, handler)
+	MakeCall("GET", "/directive", t, handler)
+	time.Sleep(1100 * time.Millisecond)
+
+	resp := MakeCall("GET", "/swr", t, handler)
+	if resp.Header().Get("X-Retter") != "stale" || resp.Header().Get("Warning") != `110 - "Response is Stale"` || resp.Header().Get("Age") != "1" {
+		t.Fatalf("Expect stale response while revalidating but %s - %s", resp.Header().Get("X-Retter"), resp.Header().Get("Warning"))
+	}
+	handler.background.Wait()
+	resp = MakeCall("GET", "/swr", t, handler)
+	if resp.Header().Get("X-Retter") != "cache-hit" || resp.Body.String() != "response 3" {
+		t.Fatalf("Expect refreshed response to be a cache hit but %s - %s", resp.Header().Get("X-Retter"), resp.Body.String())
+	}
+
+	// stale-while-revalidate of 10 seconds is configured, but not stale-if-error,
+	// only the backend's stale-if-error directive allows the stale response to be served on error.
+	handler.CacheFirst = false
+	atomic.StoreInt32(&fail, 1)
+	resp = MakeCall("GET", "/directive", t, handler)
+	if resp.Header().Get("X-Retter") != "stale" || resp.Header().Get("Warning") != `111 - "Revalidation Failed"` || resp.Body.String() != "response 2" {
+		t.Fatalf("Expect stale response on error but %s - %s", resp.Header().Get("X-Retter"), resp.Header().Get("Warning"))
+	}
+	resp = MakeCall("GET", "/swr", t, handler)
+	if resp.Header().Get("X-Retter") != "cache" {
+		t.Fatalf("Expect fresh cached response on error but %s", resp.Header().Get("X-Retter"))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resp = MakeCall("GET", "/swr", t, handler)
+	if resp.Header().Get("X-Retter") != "last-known-success" {
+		t.Fatalf("Expect stale response without stale-if-error to fallback to last known success but %s", resp.Header().Get("X-Retter"))
+	}
+}
+
+func TestStaleIfErrorBoundsLastKnown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch req.URL.Path {
+		case "/strict", "/strict/recent":
+			res.Header().Set("Cache-Control", "max-age=10, stale-if-error=5")
+		case "/revalidate":
+			res.Header().Set("Cache-Control", "max-age=10, must-revalidate")
+		default:
+			res.Header().Set("Cache-Control", "max-age=10")
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("response of " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheHTTPSemantics] = "true"
+	Config[CacheStaleIfError] = "5"
+	defer func() {
+		Config[CacheHTTPSemantics] = "false"
+		Config[CacheStaleIfError] = "0"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	// the responses were stored long ago
+	age := func(path string, by time.Duration) {
+		MakeCall("GET", path, t, handler)
+		key := handler.getCacheKey(httptest.NewRequest("GET", "http://localhost"+path, nil))
+		tx := handler.LastKnownSuccess.Get(key, false, 0).(*DefaultHTTPTransaction)
+		tx.TimeStart = tx.TimeStart.Add(-by)
+		tx.TimeEnd = tx.TimeEnd.Add(-by)
+	}
+	age("/strict", time.Minute)
+	age("/strict/recent", 12*time.Second)
+	age("/revalidate", time.Minute)
+	age("/lenient", time.Minute)
+	handler.Cache.Clear()
+	atomic.StoreInt32(&fail, 1)
+
+	for path, source := range map[string]string{
+		"/strict":        "no-cache",
+		"/strict/recent": "stale",
+		"/revalidate":    "no-cache",
+		"/lenient":       "last-known-success",
+	} {
+		if resp := MakeCall("GET", path, t, handler); resp.Header().Get("X-Retter") != source {
+			t.Errorf("Expect %s served from %s but %s", path, source, resp.Header().Get("X-Retter"))
+		}
+	}
+}
+
 func MakeCall(method, path string, t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
 	r, err := http.NewRequest(method, "http://localhost"+path, nil)
 	if err != nil {
@@ -154,3 +442,61 @@ func MakeCall(method, path string, t *testing.T, handler http.Handler) *httptest
 
 	return resp
 }
+
+func TestLastKnownSuccessBounded(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body of " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheTTL] = "0"
+	Config[LastKnownMaxEntries] = "2"
+	Config[LastKnownMaxAge] = "300 milliseconds"
+	defer func() {
+		Config[CacheTTL] = "60"
+		Config[LastKnownMaxEntries] = "10000"
+		Config[LastKnownMaxAge] = "24 hours"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	for _, path := range []string{"/lastknown/a", "/lastknown/b", "/lastknown/c"} {
+		MakeCall("GET", path, t, handler)
+	}
+	if handler.Cache.Size() != 0 || handler.LastKnownSuccess.Size() != 2 {
+		t.Fatalf("Expect nothing cached and 2 last known success but %d and %d", handler.Cache.Size(), handler.LastKnownSuccess.Size())
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	resp := MakeCall("GET", "/lastknown/a", t, handler)
+	if resp.Code != http.StatusInternalServerError || resp.Header().Get("X-Retter") != "no-cache" {
+		t.Errorf("Expect evicted last known success not served but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+	resp = MakeCall("GET", "/lastknown/c", t, handler)
+	if resp.Code != http.StatusOK || resp.Header().Get("X-Retter") != "last-known-success" || resp.Body.String() != "body of /lastknown/c" {
+		t.Errorf("Expect last known success served but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	resp = MakeCall("GET", "/lastknown/c", t, handler)
+	if resp.Code != http.StatusInternalServerError || resp.Header().Get("X-Retter") != "no-cache" {
+		t.Errorf("Expect expired last known success not served but %d - %s", resp.Code, resp.Header().Get("X-Retter"))
+	}
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	if health.LastKnownCount != 0 || health.LastKnownEviction != 1 || health.LastKnownExpiration != 2 {
+		t.Errorf("Unexpected last known success metrics %d - %d - %d", health.LastKnownCount, health.LastKnownEviction, health.LastKnownExpiration)
+	}
+}
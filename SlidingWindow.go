@@ -0,0 +1,215 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"time"
+)
+
+// Clock tells the time to the CircuitBreaker, a fake clock in the tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+// Now return the current time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// slidingWindow counts the outcome of the recent calls.
+type slidingWindow interface {
+	// record the outcome of a call, return true if the window started over before counting it.
+	record(now time.Time, failed, slow bool) bool
+
+	// totals return the number of calls, failed calls and slow calls in the window.
+	totals(now time.Time) (requests, failures, slow uint32)
+
+	// reset empty the window.
+	reset()
+}
+
+// fixedWindow counts the calls of an interval, starting over once the interval is over.
+// A zero interval never starts over, the calls are counted until the breaker changes state.
+type fixedWindow struct {
+	interval time.Duration
+	start    time.Time
+	requests uint32
+	failures uint32
+	slow     uint32
+}
+
+func (fw *fixedWindow) record(now time.Time, failed, slow bool) bool {
+	over := fw.over(now)
+	if over {
+		fw.reset()
+	}
+	if fw.start.IsZero() {
+		fw.start = now
+	}
+	fw.requests++
+	if failed {
+		fw.failures++
+	}
+	if slow {
+		fw.slow++
+	}
+	return over
+}
+
+func (fw *fixedWindow) totals(now time.Time) (uint32, uint32, uint32) {
+	if fw.over(now) {
+		return 0, 0, 0
+	}
+	return fw.requests, fw.failures, fw.slow
+}
+
+func (fw *fixedWindow) reset() {
+	fw.start = time.Time{}
+	fw.requests, fw.failures, fw.slow = 0, 0, 0
+}
+
+// over check whether the interval of the window is over.
+func (fw *fixedWindow) over(now time.Time) bool {
+	return fw.interval > 0 && !fw.start.IsZero() && now.Sub(fw.start) >= fw.interval
+}
+
+// callOutcome is the outcome of a call in the countWindow.
+type callOutcome struct {
+	failed bool
+	slow   bool
+}
+
+// newCountWindow creates a countWindow of the last size calls, 100 if size is not set.
+func newCountWindow(size int) *countWindow {
+	if size <= 0 {
+		size = 100
+	}
+	return &countWindow{outcomes: make([]callOutcome, size)}
+}
+
+// countWindow counts the last calls in a ring, replacing the oldest call once full.
+type countWindow struct {
+	outcomes []callOutcome
+	next     int
+	filled   int
+	failures uint32
+	slow     uint32
+}
+
+func (cw *countWindow) record(now time.Time, failed, slow bool) bool {
+	if cw.filled == len(cw.outcomes) {
+		oldest := cw.outcomes[cw.next]
+		if oldest.failed {
+			cw.failures--
+		}
+		if oldest.slow {
+			cw.slow--
+		}
+	} else {
+		cw.filled++
+	}
+	cw.outcomes[cw.next] = callOutcome{failed: failed, slow: slow}
+	if failed {
+		cw.failures++
+	}
+	if slow {
+		cw.slow++
+	}
+	cw.next = (cw.next + 1) % len(cw.outcomes)
+	return false
+}
+
+func (cw *countWindow) totals(now time.Time) (uint32, uint32, uint32) {
+	return uint32(cw.filled), cw.failures, cw.slow
+}
+
+func (cw *countWindow) reset() {
+	for i := range cw.outcomes {
+		cw.outcomes[i] = callOutcome{}
+	}
+	cw.next, cw.filled, cw.failures, cw.slow = 0, 0, 0, 0
+}
+
+// callBucket counts the calls of one slice of the timeWindow.
+type callBucket struct {
+	index    int64
+	requests uint32
+	failures uint32
+	slow     uint32
+}
+
+// newTimeWindow creates a timeWindow of the given length split in buckets,
+// 10 seconds in 10 buckets if not set.
+func newTimeWindow(length time.Duration, buckets int) *timeWindow {
+	if length <= 0 {
+		length = 10 * time.Second
+	}
+	if buckets <= 0 {
+		buckets = 10
+	}
+	bucketSize := length / time.Duration(buckets)
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	return &timeWindow{bucketSize: bucketSize, buckets: make([]callBucket, buckets)}
+}
+
+// timeWindow counts the calls of the last length in buckets, a bucket is reused once
+// its slice of time left the window.
+type timeWindow struct {
+	bucketSize time.Duration
+	buckets    []callBucket
+}
+
+func (tw *timeWindow) record(now time.Time, failed, slow bool) bool {
+	index := now.UnixNano() / int64(tw.bucketSize)
+	bucket := &tw.buckets[index%int64(len(tw.buckets))]
+	if bucket.index != index {
+		*bucket = callBucket{index: index}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+	return false
+}
+
+func (tw *timeWindow) totals(now time.Time) (requests, failures, slow uint32) {
+	index := now.UnixNano() / int64(tw.bucketSize)
+	for _, bucket := range tw.buckets {
+		if bucket.index > index-int64(len(tw.buckets)) && bucket.index <= index {
+			requests += bucket.requests
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	return requests, failures, slow
+}
+
+func (tw *timeWindow) reset() {
+	for i := range tw.buckets {
+		tw.buckets[i] = callBucket{}
+	}
+}
@@ -0,0 +1,309 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"errors"
+	"github.com/sony/gobreaker"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock only moving when told to.
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+var errCall = errors.New("call failed")
+
+func succeed() (interface{}, error) {
+	return "ok", nil
+}
+
+func fail() (interface{}, error) {
+	return nil, errCall
+}
+
+func TestCountWindowBreaker(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newCircuitBreaker("count", BreakerPolicy{
+		MaxRequests:     2,
+		Timeout:         5 * time.Second,
+		FailureRate:     0.5,
+		MinRequests:     10,
+		ConsecutiveFail: 100,
+		Window:          BreakerWindowCount,
+		WindowSize:      10,
+	}, clock)
+
+	for i := 0; i < 5; i++ {
+		breaker.Execute(succeed)
+		breaker.Execute(fail)
+	}
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect 5 failures of 10 calls to keep the breaker closed but %s", getGoBreakerString(breaker.State()))
+	}
+
+	// the oldest call, a success, leaves the window
+	breaker.Execute(fail)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("Expect 6 failures of the last 10 calls to trip the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+	if _, err := breaker.Execute(succeed); err != gobreaker.ErrOpenState {
+		t.Errorf("Expect open breaker to refuse the call but %v", err)
+	}
+
+	clock.Advance(4 * time.Second)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Errorf("Expect breaker to stay open until the timeout but %s", getGoBreakerString(breaker.State()))
+	}
+	clock.Advance(time.Second)
+	if breaker.State() != gobreaker.StateHalfOpen {
+		t.Fatalf("Expect breaker half-open after the timeout but %s", getGoBreakerString(breaker.State()))
+	}
+
+	// a failed trial call opens it again
+	breaker.Execute(fail)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("Expect failed trial call to open the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+	clock.Advance(5 * time.Second)
+	if _, err := breaker.Execute(succeed); err != nil {
+		t.Errorf("Expect first trial call to pass but %v", err)
+	}
+	if breaker.State() != gobreaker.StateHalfOpen {
+		t.Errorf("Expect breaker to stay half-open until %d successful trial calls but %s", 2, getGoBreakerString(breaker.State()))
+	}
+	if _, err := breaker.Execute(succeed); err != nil {
+		t.Errorf("Expect second trial call to pass but %v", err)
+	}
+	if breaker.State() != gobreaker.StateClosed {
+		t.Fatalf("Expect successful trial calls to close the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+
+	// the window starts over once closed
+	for i := 0; i < 9; i++ {
+		breaker.Execute(fail)
+	}
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect breaker to wait for %d calls but %s", 10, getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestTimeWindowBreaker(t *testing.T) {
+	clock := newFakeClock()
+	policy := BreakerPolicy{
+		MaxRequests:     1,
+		Interval:        10 * time.Second,
+		Timeout:         5 * time.Second,
+		FailureRate:     0.5,
+		MinRequests:     10,
+		ConsecutiveFail: 100,
+		Window:          BreakerWindowTime,
+		WindowBuckets:   10,
+	}
+	breaker := newCircuitBreaker("time", policy, clock)
+
+	// failures straddling the end of a fixed interval
+	clock.Advance(7 * time.Second)
+	for i := 0; i < 5; i++ {
+		breaker.Execute(fail)
+		clock.Advance(500 * time.Millisecond)
+	}
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect breaker to wait for %d calls but %s", 10, getGoBreakerString(breaker.State()))
+	}
+	for i := 0; i < 5; i++ {
+		breaker.Execute(fail)
+		clock.Advance(500 * time.Millisecond)
+	}
+	if breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("Expect failures across the interval boundary to trip the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+	clock.Advance(5 * time.Second)
+	breaker.Execute(succeed)
+	if breaker.State() != gobreaker.StateClosed {
+		t.Fatalf("Expect successful trial call to close the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+
+	// failures leave the window as time goes by
+	breaker = newCircuitBreaker("time", policy, clock)
+	for i := 0; i < 6; i++ {
+		breaker.Execute(fail)
+	}
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 4; i++ {
+		breaker.Execute(fail)
+	}
+	for i := 0; i < 6; i++ {
+		breaker.Execute(succeed)
+	}
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect failures older than the window not to count but %s", getGoBreakerString(breaker.State()))
+	}
+	for i := 0; i < 3; i++ {
+		breaker.Execute(fail)
+	}
+	if breaker.State() != gobreaker.StateOpen {
+		t.Errorf("Expect 7 failures of 13 calls in the window to trip but %s", getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestSlidingWindowSlowCalls(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newCircuitBreaker("slow", BreakerPolicy{
+		MaxRequests:         1,
+		Timeout:             5 * time.Second,
+		FailureRate:         0.5,
+		MinRequests:         100,
+		ConsecutiveFail:     100,
+		SlowCallDuration:    time.Second,
+		SlowCallRate:        0.5,
+		SlowCallMinRequests: 4,
+		Window:              BreakerWindowCount,
+		WindowSize:          4,
+	}, clock)
+	slow := func() (interface{}, error) {
+		clock.Advance(2 * time.Second)
+		return "slow", nil
+	}
+
+	breaker.Execute(succeed)
+	breaker.Execute(slow)
+	breaker.Execute(succeed)
+	if result, err := breaker.Execute(slow); result != "slow" || err != nil {
+		t.Errorf("Expect slow call to return its result but %v - %v", result, err)
+	}
+	if breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("Expect 2 slow calls of 4 to trip the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+
+	// a slow trial call opens it again
+	clock.Advance(5 * time.Second)
+	breaker.Execute(slow)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Errorf("Expect slow trial call to open the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestSlidingWindowHalfOpen(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newCircuitBreaker("half-open", BreakerPolicy{
+		MaxRequests:     1,
+		Timeout:         5 * time.Second,
+		MinRequests:     100,
+		ConsecutiveFail: 1,
+		Window:          BreakerWindowCount,
+		WindowSize:      10,
+	}, clock)
+	breaker.Execute(fail)
+	breaker.Execute(fail)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("Expect consecutive failures to trip the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+	clock.Advance(5 * time.Second)
+
+	// a second call while the trial call is running is refused
+	inTrial := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		breaker.Execute(func() (interface{}, error) {
+			inTrial <- true
+			<-done
+			return "ok", nil
+		})
+		close(inTrial)
+	}()
+	<-inTrial
+	if _, err := breaker.Execute(succeed); err != gobreaker.ErrTooManyRequests {
+		t.Errorf("Expect call during the trial to be refused but %v", err)
+	}
+	close(done)
+	<-inTrial
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect successful trial call to close the breaker but %s", getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestFixedWindowBreaker(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newCircuitBreaker("fixed", BreakerPolicy{
+		MaxRequests:     1,
+		Interval:        10 * time.Second,
+		Timeout:         5 * time.Second,
+		FailureRate:     0.5,
+		MinRequests:     100,
+		ConsecutiveFail: 2,
+		Window:          BreakerWindowFixed,
+	}, clock)
+
+	// the counts, consecutive failures included, start over every interval
+	breaker.Execute(succeed)
+	breaker.Execute(fail)
+	breaker.Execute(fail)
+	clock.Advance(10 * time.Second)
+	breaker.Execute(fail)
+	breaker.Execute(succeed)
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect failures of the previous interval not to count but %s", getGoBreakerString(breaker.State()))
+	}
+	breaker.Execute(fail)
+	breaker.Execute(fail)
+	if breaker.State() != gobreaker.StateClosed {
+		t.Errorf("Expect %d consecutive failures to keep the breaker closed but %s", 2, getGoBreakerString(breaker.State()))
+	}
+	breaker.Execute(fail)
+	if breaker.State() != gobreaker.StateOpen {
+		t.Errorf("Expect %d consecutive failures to trip the breaker but %s", 3, getGoBreakerString(breaker.State()))
+	}
+}
+
+func TestNewBreakerWindow(t *testing.T) {
+	for window, fixed := range map[string]bool{BreakerWindowFixed: true, "": true, BreakerWindowCount: false, BreakerWindowTime: false} {
+		_, isFixed := NewCircuitBreaker("window", BreakerPolicy{Window: window}).window.(*fixedWindow)
+		if isFixed != fixed {
+			t.Errorf("Expect window %q fixed %v but %v", window, fixed, isFixed)
+		}
+	}
+	policy := BreakerPolicy{}
+	if err := applyBreakerConfig(&policy, &BreakerConfig{Window: "time", WindowBuckets: 5}); err != nil || policy.Window != BreakerWindowTime || policy.WindowBuckets != 5 {
+		t.Errorf("Unexpected policy %v - %v", policy, err)
+	}
+	if err := applyBreakerConfig(&policy, &BreakerConfig{Window: "rolling"}); err == nil {
+		t.Errorf("Expect error for unknown window")
+	}
+}
@@ -0,0 +1,73 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RequestStats keeps the number of requests served by a RetterHTTPHandler and their response times.
+// It's safe for concurrent use.
+type RequestStats struct {
+	count     uint64
+	totalMs   uint64
+	slowestMs uint64
+	fastestMs uint64
+}
+
+// Record a served request that took the duration.
+func (rs *RequestStats) Record(duration time.Duration) {
+	ms := uint64(duration / time.Millisecond)
+	atomic.AddUint64(&rs.count, 1)
+	atomic.AddUint64(&rs.totalMs, ms)
+	for {
+		slowest := atomic.LoadUint64(&rs.slowestMs)
+		if slowest >= ms || atomic.CompareAndSwapUint64(&rs.slowestMs, slowest, ms) {
+			break
+		}
+	}
+	for {
+		// zero fastest means there is no fastest yet
+		fastest := atomic.LoadUint64(&rs.fastestMs)
+		if (fastest != 0 && fastest <= ms) || atomic.CompareAndSwapUint64(&rs.fastestMs, fastest, ms) {
+			break
+		}
+	}
+}
+
+// Count return the number of served requests.
+func (rs *RequestStats) Count() uint64 {
+	return atomic.LoadUint64(&rs.count)
+}
+
+// TotalMs return the total response time of all served requests, in millisecond.
+func (rs *RequestStats) TotalMs() uint64 {
+	return atomic.LoadUint64(&rs.totalMs)
+}
+
+// SlowestMs return the slowest response time, in millisecond.
+func (rs *RequestStats) SlowestMs() uint64 {
+	return atomic.LoadUint64(&rs.slowestMs)
+}
+
+// FastestMs return the fastest response time, in millisecond.
+func (rs *RequestStats) FastestMs() uint64 {
+	return atomic.LoadUint64(&rs.fastestMs)
+}
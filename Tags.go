@@ -0,0 +1,198 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"github.com/hyperjumptech/retter/cache"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewTagIndex creates a new TagIndex taking the tags of responses from the specified headers.
+func NewTagIndex(headers []string) *TagIndex {
+	return &TagIndex{
+		Headers: headers,
+		keys:    make(map[string]map[string]bool),
+		tags:    make(map[string][]string),
+	}
+}
+
+// TagIndex keeps the cache keys of stored responses by their tags, so every response carrying a tag
+// can be purged at once. The tags of a response are taken from its headers, such as
+// Surrogate-Key (space separated) or Cache-Tag (comma separated).
+type TagIndex struct {
+	// Headers are the response headers carrying the tags.
+	Headers []string
+
+	keys  map[string]map[string]bool
+	tags  map[string][]string
+	mutex sync.Mutex
+}
+
+// TagsOf return the tags in the response header.
+func (ti *TagIndex) TagsOf(header http.Header) []string {
+	tags := make([]string, 0)
+	for _, name := range ti.Headers {
+		for _, value := range header.Values(name) {
+			for _, tag := range strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			}) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// Tag index the key under the tags in the response header, replacing the tags it had before.
+func (ti *TagIndex) Tag(key string, header http.Header) {
+	tags := ti.TagsOf(header)
+
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+
+	ti.untag(key)
+	if len(tags) == 0 {
+		return
+	}
+	for _, tag := range tags {
+		keys, ok := ti.keys[tag]
+		if !ok {
+			keys = make(map[string]bool)
+			ti.keys[tag] = keys
+		}
+		keys[key] = true
+	}
+	ti.tags[key] = tags
+}
+
+// Untag removes the key from the index.
+func (ti *TagIndex) Untag(key string) {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+
+	ti.untag(key)
+}
+
+// untag removes the key from the index. Caller must hold the lock.
+func (ti *TagIndex) untag(key string) {
+	for _, tag := range ti.tags[key] {
+		if keys, ok := ti.keys[tag]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(ti.keys, tag)
+			}
+		}
+	}
+	delete(ti.tags, key)
+}
+
+// Keys return the sorted keys tagged with any of the tags.
+func (ti *TagIndex) Keys(tags ...string) []string {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+
+	union := make(map[string]bool)
+	for _, tag := range tags {
+		for key := range ti.keys[tag] {
+			union[key] = true
+		}
+	}
+	keys := make([]string, 0, len(union))
+	for key := range union {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Size return the number of distinct tags in the index.
+func (ti *TagIndex) Size() int {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+
+	return len(ti.keys)
+}
+
+// Clear removes all keys from the index.
+func (ti *TagIndex) Clear() {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+
+	ti.keys = make(map[string]map[string]bool)
+	ti.tags = make(map[string][]string)
+}
+
+// tagHeaders return the configured tag headers.
+func tagHeaders() []string {
+	headers := make([]string, 0)
+	for _, header := range strings.Split(Config.GetString(CacheTagHeaders), ",") {
+		if header = strings.TrimSpace(header); len(header) > 0 {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// indexStoredTags tag the responses already in the stores, such as those loaded from disk on startup.
+func (rhh *RetterHTTPHandler) indexStoredTags() {
+	if len(rhh.Tags.Headers) == 0 {
+		return
+	}
+	for _, store := range []cache.Store{rhh.Cache, rhh.LastKnownSuccess} {
+		lister, ok := store.(cache.Lister)
+		if !ok {
+			continue
+		}
+		for _, info := range lister.Entries() {
+			if tx, ok := store.Get(info.Key, false, 0).(HTTPTransaction); ok {
+				rhh.Tags.Tag(info.Key, tx.Response().Header())
+			}
+		}
+	}
+}
+
+// untagEvicted untag a key evicted or expired from one of the stores, once it's in neither of them.
+func (rhh *RetterHTTPHandler) untagEvicted(key string) {
+	if rhh.Cache.Get(key, false, 0) == nil && rhh.LastKnownSuccess.Get(key, false, 0) == nil {
+		rhh.Tags.Untag(key)
+	}
+}
+
+// PurgeTags delete every response tagged with any of the tags from the stores, both the cache
+// and the last known success if no store is specified. Return the number of purged keys.
+func (rhh *RetterHTTPHandler) PurgeTags(tags []string, stores ...cache.Store) int {
+	untag := len(stores) == 0
+	if untag {
+		stores = []cache.Store{rhh.Cache, rhh.LastKnownSuccess}
+	}
+	keys := rhh.Tags.Keys(tags...)
+	for _, key := range keys {
+		for _, store := range stores {
+			store.Delete(key)
+		}
+		if untag {
+			rhh.Tags.Untag(key)
+		}
+	}
+	serverLog.Debugf("purged %d keys tagged with %v", len(keys), tags)
+	return len(keys)
+}
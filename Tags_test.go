@@ -0,0 +1,150 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/hyperjumptech/retter/cache"
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagIndex(t *testing.T) {
+	index := NewTagIndex([]string{"Surrogate-Key", "Cache-Tag"})
+	header := http.Header{}
+	header.Set("Surrogate-Key", "product-1  catalogue")
+	header.Set("Cache-Tag", "shoes,sale")
+	if tags := index.TagsOf(header); !reflect.DeepEqual(tags, []string{"product-1", "catalogue", "shoes", "sale"}) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	index.Tag("/products/1", header)
+	index.Tag("/products/2", http.Header{"Surrogate-Key": {"product-2 catalogue"}})
+	if keys := index.Keys("catalogue"); !reflect.DeepEqual(keys, []string{"/products/1", "/products/2"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if keys := index.Keys("sale", "product-2"); !reflect.DeepEqual(keys, []string{"/products/1", "/products/2"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	// tagging again replace the previous tags
+	index.Tag("/products/1", http.Header{"Surrogate-Key": {"product-1"}})
+	if keys := index.Keys("catalogue"); !reflect.DeepEqual(keys, []string{"/products/2"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if index.Size() != 3 {
+		t.Errorf("Expect 3 tags but %d", index.Size())
+	}
+	index.Untag("/products/2")
+	if index.Size() != 1 || len(index.Keys("catalogue")) != 0 {
+		t.Errorf("Expect 1 tag left but %d", index.Size())
+	}
+}
+
+func TestPurgeByTag(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/products/") {
+			res.Header().Set("Surrogate-Key", "catalogue product-"+strings.TrimPrefix(req.URL.Path, "/products/"))
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body of " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheStore] = cache.DiskStoreName
+	Config[CacheDiskDir] = dir
+	defer func() {
+		Config[CacheStore] = cache.MemoryStoreName
+	}()
+
+	handler := NewRetterHTTPHandler()
+	for _, path := range []string{"/products/1", "/products/2", "/products/3", "/users/1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost"+path, nil))
+	}
+	if purged := handler.PurgeTags([]string{"product-2"}); purged != 1 {
+		t.Errorf("Expect 1 key purged but %d", purged)
+	}
+	handler.Close()
+
+	// the tags of the responses on disk are indexed again on restart
+	handler = NewRetterHTTPHandler()
+	defer handler.Close()
+	if handler.Cache.Size() != 3 || handler.Tags.Size() != 3 {
+		t.Fatalf("Expect 3 cached responses and 3 tags but %d and %d", handler.Cache.Size(), handler.Tags.Size())
+	}
+
+	admin := NewAdminHTTPHandler(handler, "secret")
+	req := httptest.NewRequest("DELETE", "http://localhost:8090/cache/tag?tag=catalogue", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"deleted":2}` {
+		t.Errorf("Unexpected purge response %d - %s", resp.Code, resp.Body.String())
+	}
+	if handler.Cache.Size() != 1 || handler.LastKnownSuccess.Size() != 1 || handler.Cache.Get("/users/1", false, 0) == nil {
+		t.Errorf("Expect only /users/1 left but %d and %d", handler.Cache.Size(), handler.LastKnownSuccess.Size())
+	}
+	if handler.Tags.Size() != 0 {
+		t.Errorf("Expect no tag left but %d", handler.Tags.Size())
+	}
+}
+
+func TestTagsFollowEvictions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Surrogate-Key", "catalogue")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte("body of " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[CacheMaxEntries] = "2"
+	Config[LastKnownMaxEntries] = "3"
+	defer func() {
+		Config[CacheMaxEntries] = "0"
+		Config[LastKnownMaxEntries] = "10000"
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	for i := 1; i <= 5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("http://localhost/products/%d", i), nil))
+	}
+	// the keys evicted from the cache stay tagged while they're still a last known success
+	if keys := handler.Tags.Keys("catalogue"); !reflect.DeepEqual(keys, []string{"/products/3", "/products/4", "/products/5"}) {
+		t.Errorf("Expect only the stored keys tagged but %v", keys)
+	}
+}
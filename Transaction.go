@@ -19,11 +19,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -45,6 +47,32 @@ type HTTPTransaction interface {
 	TransactionDuration() time.Duration
 	Request() *http.Request
 	Response() *httptest.ResponseRecorder
+	Freshness() Freshness
+}
+
+// Freshness tells how long a stored transaction is fresh since it is received,
+// and for how long it may still be served once it becomes stale.
+type Freshness struct {
+	// TTL is how long the transaction is fresh.
+	TTL time.Duration
+
+	// StaleWhileRevalidate is how long a stale transaction may be served while it is refreshed in the background.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long a stale transaction may be served when the backend fails.
+	StaleIfError time.Duration
+
+	// StrictStaleIfError is true when the backend itself bounds serving the stale transaction on error, with
+	// stale-if-error or must-revalidate. Beyond StaleIfError it's not served at all, not even as last known success.
+	StrictStaleIfError bool
+}
+
+// Retention is how long a transaction with this freshness should be kept in the cache.
+func (f Freshness) Retention() time.Duration {
+	if f.StaleWhileRevalidate > f.StaleIfError {
+		return f.TTL + f.StaleWhileRevalidate
+	}
+	return f.TTL + f.StaleIfError
 }
 
 // DefaultHTTPTransaction is the default implementation of HTTPTransaction
@@ -53,6 +81,7 @@ type DefaultHTTPTransaction struct {
 	TimeEnd   time.Time
 	Rec       *http.Request
 	Res       *httptest.ResponseRecorder
+	Fresh     Freshness
 }
 
 // TransactionBeginTime return the time when the transaction begins.
@@ -75,6 +104,138 @@ func (tx *DefaultHTTPTransaction) Response() *httptest.ResponseRecorder {
 	return tx.Res
 }
 
+// Freshness of the transaction
+func (tx *DefaultHTTPTransaction) Freshness() Freshness {
+	return tx.Fresh
+}
+
+// ByteSize return the size of the response body of this transaction.
+func (tx *DefaultHTTPTransaction) ByteSize() int64 {
+	if tx.Res == nil || tx.Res.Body == nil {
+		return 0
+	}
+	return int64(tx.Res.Body.Len())
+}
+
+// AgeOf return the age of a stored transaction, that is how long since it was received from the backend,
+// plus the Age the backend itself reported.
+func AgeOf(tx HTTPTransaction, now time.Time) time.Duration {
+	age := now.Sub(tx.TransactionBeginTime().Add(tx.TransactionDuration()))
+	if backendAge, err := strconv.ParseInt(tx.Response().Header().Get("Age"), 10, 64); err == nil && backendAge > 0 {
+		age += time.Duration(backendAge) * time.Second
+	}
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// StalenessOf return how long a stored transaction has been stale. It is negative while the transaction is still fresh.
+func StalenessOf(tx HTTPTransaction, now time.Time) time.Duration {
+	return now.Sub(tx.TransactionBeginTime().Add(tx.TransactionDuration() + tx.Freshness().TTL))
+}
+
+// TransactionCodec is a cache.Codec to serialize HTTPTransaction, so it can be kept in a persistent cache store.
+// The request body is not serialized, nor the request headers other than those the response varies by.
+type TransactionCodec struct{}
+
+// credentialHeaders are the request headers never written into a persistent cache store, even if the response
+// varies by them.
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// hasCredentials check whether the request carries any of the credentialHeaders.
+func hasCredentials(req *http.Request) bool {
+	for name := range credentialHeaders {
+		if len(req.Header.Get(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionRecord is the serialized form of HTTPTransaction.
+type transactionRecord struct {
+	TimeStart      time.Time   `json:"time-start"`
+	TimeEnd        time.Time   `json:"time-end"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request-header"`
+	StatusCode     int         `json:"status-code"`
+	ResponseHeader http.Header `json:"response-header"`
+	Body           []byte      `json:"body"`
+	Freshness      Freshness   `json:"freshness"`
+}
+
+// Encode an HTTPTransaction into bytes
+func (codec *TransactionCodec) Encode(value interface{}) ([]byte, error) {
+	tx, ok := value.(HTTPTransaction)
+	if !ok {
+		return nil, fmt.Errorf("can not encode %T, it is not an HTTPTransaction", value)
+	}
+	record := &transactionRecord{
+		TimeStart:      tx.TransactionBeginTime(),
+		TimeEnd:        tx.TransactionBeginTime().Add(tx.TransactionDuration()),
+		StatusCode:     tx.Response().Code,
+		ResponseHeader: tx.Response().Header(),
+		Body:           tx.Response().Body.Bytes(),
+		Freshness:      tx.Freshness(),
+	}
+	if req := tx.Request(); req != nil {
+		record.Method = req.Method
+		record.URL = req.URL.String()
+		record.RequestHeader = persistedRequestHeader(req.Header, tx.Response().Header())
+	}
+	return json.Marshal(record)
+}
+
+// persistedRequestHeader return the request headers to serialize with the transaction, the ones named in the Vary of
+// its response, without the credentials.
+func persistedRequestHeader(header, responseHeader http.Header) http.Header {
+	persisted := make(http.Header)
+	for _, name := range VaryHeaders(responseHeader) {
+		if values := header.Values(name); len(values) > 0 && !credentialHeaders[name] {
+			persisted[name] = values
+		}
+	}
+	return persisted
+}
+
+// Decode bytes back into an HTTPTransaction
+func (codec *TransactionCodec) Decode(data []byte) (interface{}, error) {
+	record := &transactionRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	recorder := httptest.NewRecorder()
+	for k, v := range record.ResponseHeader {
+		for _, val := range v {
+			recorder.Header().Add(k, val)
+		}
+	}
+	recorder.WriteHeader(record.StatusCode)
+	recorder.Write(record.Body)
+
+	tx := &DefaultHTTPTransaction{
+		TimeStart: record.TimeStart,
+		TimeEnd:   record.TimeEnd,
+		Res:       recorder,
+		Fresh:     record.Freshness,
+	}
+	if len(record.Method) > 0 {
+		req, err := http.NewRequest(record.Method, record.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = record.RequestHeader
+		tx.Rec = req
+	}
+	return tx, nil
+}
+
 func init() {
 	regex, err := regexp.Compile(`(ci_session|JSESSIONID|PHPSESSID)\s*=\s*[a-zA-Z0-9.\-]+`)
 	if err != nil {
@@ -98,5 +259,9 @@ func getKey(req *http.Request) string {
 			completePath = fmt.Sprintf("%s:%s", cookie, completePath)
 		}
 	}
+	// only GET is cached by default, keys of other cacheable methods are prefixed by their method
+	if req.Method != http.MethodGet {
+		completePath = fmt.Sprintf("%s %s", req.Method, completePath)
+	}
 	return completePath
 }
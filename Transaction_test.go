@@ -0,0 +1,86 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"github.com/hyperjumptech/retter/cache"
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransactionCodecDropsCredentials(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := cache.NewDiskStore(cache.Options{Dir: dir, Codec: &TransactionCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		store.Close()
+	}()
+
+	req := httptest.NewRequest("GET", "http://localhost/account", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Proxy-Authorization", "Basic secret-proxy")
+	req.Header.Set("Cookie", "PHPSESSID=secret-session")
+	req.Header.Set("Accept-Language", "id")
+	req.Header.Set("User-Agent", "secret-agent")
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Vary", "Accept-Language, Cookie")
+	recorder.WriteHeader(http.StatusOK)
+	recorder.Write([]byte("account"))
+	store.Set("account", &DefaultHTTPTransaction{Rec: req, Res: recorder, TimeStart: time.Now(), TimeEnd: time.Now()}, 0)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) == 0 {
+		t.Fatalf("Expect the transaction written into %s", dir)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("Expect only the vary headers without credentials written but %s", string(data))
+		}
+	}
+
+	store.Close()
+	store, err = cache.NewDiskStore(cache.Options{Dir: dir, Codec: &TransactionCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := store.Get("account", false, 0).(HTTPTransaction)
+	if header := tx.Request().Header; len(header) != 1 || header.Get("Accept-Language") != "id" {
+		t.Errorf("Expect only Accept-Language read back but %v", header)
+	}
+}
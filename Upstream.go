@@ -0,0 +1,263 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+const (
+	// UpstreamDefault is the name of the upstream of requests not matching any configured upstream,
+	// which is the backend.baseurl.
+	UpstreamDefault = "default"
+)
+
+// UpstreamConfig is an upstream as written in the configuration.
+// A request is routed to the upstream if its Host header matches any of the Hosts, an exact host name
+// or a wildcard such as *.example.com, and its path is the PathPrefix or below it. Empty Hosts matches any host.
+// An upstream of several instances lists them in BaseURLs, calls are distributed by the Balancer.
+type UpstreamConfig struct {
+	Name       string         `json:"name"`
+	BaseURL    string         `json:"baseurl"`
+	BaseURLs   []string       `json:"baseurls"`
+	Balancer   string         `json:"balancer"`
+	Hosts      []string       `json:"hosts"`
+	PathPrefix string         `json:"path-prefix"`
+	HealthPath string         `json:"health-path"`
+	Breaker    *BreakerConfig `json:"breaker"`
+}
+
+// NewUpstream creates a new Upstream with its own breakers, balancing calls across the base URLs.
+func NewUpstream(name string, baseURLs []string, balancer string, hosts []string, pathPrefix string) (*Upstream, error) {
+	policy := NewInstanceBreakerPolicy()
+	instances := make([]*Instance, 0, len(baseURLs))
+	for _, baseURL := range baseURLs {
+		instances = append(instances, NewInstance(baseURL, policy))
+	}
+	bal, err := NewBalancer(balancer, instances)
+	if err != nil {
+		return nil, err
+	}
+	breakerPolicy := NewAggregateBreakerPolicy(Config.GetFloat(BackendFailureRate), Config.GetInt(BackendMinRequests))
+	return &Upstream{
+		Name:          name,
+		Hosts:         hosts,
+		PathPrefix:    pathPrefix,
+		HealthPath:    Config.GetString(HealthCheckPath),
+		Instances:     instances,
+		Balancer:      bal,
+		BreakerPolicy: breakerPolicy,
+		Breaker:       NewCircuitBreaker(name, breakerPolicy),
+		RouteBreakers: NewBreakerRegistry(0, 0),
+		Breakers:      NewBreakerRegistry(Config.GetInt(BreakerMaxCount), Config.GetDuration(BreakerIdleTimeout)),
+	}, nil
+}
+
+// Upstream is a named backend protected by RETTER, with its own breakers and cache namespace.
+type Upstream struct {
+	Name       string
+	Hosts      []string
+	PathPrefix string
+
+	// HealthPath is the path the health checker calls on each instance, empty if the instances are not probed.
+	HealthPath string
+
+	// Instances are the base URLs of this upstream, each with its own breaker.
+	Instances []*Instance
+
+	// Balancer pick the instance to call for each request.
+	Balancer Balancer
+
+	// BreakerPolicy is the thresholds of the Breaker.
+	BreakerPolicy BreakerPolicy
+
+	// Breaker is the breaker of the whole upstream, it trips when too many of the calls fail.
+	Breaker Breaker
+
+	// RouteBreakers keep the circuit breaker of each route to this upstream.
+	RouteBreakers *BreakerRegistry
+
+	// Breakers keep the circuit breaker of each request key to this upstream.
+	Breakers *BreakerRegistry
+}
+
+// Up check whether any of the instances is healthy, according to the health checker.
+func (up *Upstream) Up() bool {
+	for _, instance := range up.Instances {
+		if instance.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute call an instance picked by the balancer, recording the response into the recorder.
+// The failure classifier of the request's route tells which responses count against the instance.
+// If every instance is ejected, the recorder gets 503 Service Unavailable.
+func (up *Upstream) Execute(timeout time.Duration, failure *FailureClassifier, recorder *httptest.ResponseRecorder, req *http.Request) error {
+	instance := up.Balancer.Pick(getKey(req))
+	if instance == nil {
+		recorder.WriteHeader(http.StatusServiceUnavailable)
+		recorder.Write([]byte(ErrNoInstance.Error()))
+		return ErrNoInstance
+	}
+	return instance.Execute(timeout, failure, recorder, req)
+}
+
+// Matches check whether the request is routed to this upstream.
+func (up *Upstream) Matches(req *http.Request) bool {
+	if !matchesPathPrefix(req.URL.Path, up.PathPrefix) {
+		return false
+	}
+	if len(up.Hosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range up.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPathPrefix check whether the path is under the prefix, that is the prefix itself or the prefix
+// followed by a slash, so the prefix /api matches /api/users but not /apiv2.
+func matchesPathPrefix(path, prefix string) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Namespace return the cache key of this upstream for the request key. Keys of the default upstream
+// are not namespaced, keys of other upstreams are prefixed by the upstream name in brackets.
+func (up *Upstream) Namespace(key string) string {
+	if up.Name == UpstreamDefault {
+		return key
+	}
+	return fmt.Sprintf("[%s]%s", up.Name, key)
+}
+
+// UpstreamRouter pick the upstream of each request, the first matching upstream wins.
+type UpstreamRouter struct {
+	Upstreams []*Upstream
+	Default   *Upstream
+}
+
+// Match return the first upstream matching the request, or the default upstream.
+func (ur *UpstreamRouter) Match(req *http.Request) *Upstream {
+	for _, upstream := range ur.Upstreams {
+		if upstream.Matches(req) {
+			return upstream
+		}
+	}
+	return ur.Default
+}
+
+// All return every upstream, the default one last.
+func (ur *UpstreamRouter) All() []*Upstream {
+	return append(append([]*Upstream{}, ur.Upstreams...), ur.Default)
+}
+
+// NewUpstreamRouter creates the UpstreamRouter from the configuration. The upstreams configuration
+// is either a JSON array of UpstreamConfig or the path of a file containing it.
+// Requests not matching any upstream go to backend.baseurl.
+func NewUpstreamRouter() (*UpstreamRouter, error) {
+	upstreams := strings.TrimSpace(Config.GetString(Upstreams))
+	if len(upstreams) > 0 && !strings.HasPrefix(upstreams, "[") {
+		data, err := ioutil.ReadFile(upstreams)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = string(data)
+	}
+	defaultUpstream, err := NewDefaultUpstream(Config.GetString(BackendBalancer))
+	if err != nil {
+		return nil, err
+	}
+	return ParseUpstreamRouter(upstreams, defaultUpstream)
+}
+
+// NewDefaultUpstream creates the upstream of the comma separated backend.baseurl, with the balancer.
+func NewDefaultUpstream(balancer string) (*Upstream, error) {
+	return NewUpstream(UpstreamDefault, strings.Split(Config.GetString(BackendURL), ","), balancer, nil, "")
+}
+
+// ParseUpstreamRouter creates an UpstreamRouter from a JSON array of UpstreamConfig.
+func ParseUpstreamRouter(upstreamsJSON string, defaultUpstream *Upstream) (*UpstreamRouter, error) {
+	router := &UpstreamRouter{
+		Upstreams: make([]*Upstream, 0),
+		Default:   defaultUpstream,
+	}
+	if len(strings.TrimSpace(upstreamsJSON)) == 0 {
+		return router, nil
+	}
+	configs := make([]*UpstreamConfig, 0)
+	if err := json.Unmarshal([]byte(upstreamsJSON), &configs); err != nil {
+		return nil, fmt.Errorf("invalid upstreams. got %s", err.Error())
+	}
+	names := map[string]bool{UpstreamDefault: true}
+	for i, config := range configs {
+		switch {
+		case len(config.Name) == 0:
+			return nil, fmt.Errorf("upstream #%d has no name", i+1)
+		case names[config.Name]:
+			return nil, fmt.Errorf("upstream #%d name \"%s\" is already used", i+1, config.Name)
+		case len(config.BaseURL) == 0 && len(config.BaseURLs) == 0:
+			return nil, fmt.Errorf("upstream \"%s\" has no baseurl", config.Name)
+		case len(config.Hosts) == 0 && len(config.PathPrefix) == 0:
+			return nil, fmt.Errorf("upstream \"%s\" must have hosts or path-prefix", config.Name)
+		}
+		names[config.Name] = true
+		baseURLs := config.BaseURLs
+		if len(config.BaseURL) > 0 {
+			baseURLs = append([]string{config.BaseURL}, baseURLs...)
+		}
+		upstream, err := NewUpstream(config.Name, baseURLs, config.Balancer, config.Hosts, config.PathPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("upstream \"%s\" is invalid. got %s", config.Name, err.Error())
+		}
+		if len(config.HealthPath) > 0 {
+			upstream.HealthPath = config.HealthPath
+		}
+		if config.Breaker != nil {
+			if err := applyBreakerConfig(&upstream.BreakerPolicy, config.Breaker); err != nil {
+				return nil, fmt.Errorf("upstream \"%s\" is invalid. got %s", config.Name, err.Error())
+			}
+			upstream.Breaker = NewCircuitBreaker(config.Name, upstream.BreakerPolicy)
+		}
+		router.Upstreams = append(router.Upstreams, upstream)
+	}
+	return router, nil
+}
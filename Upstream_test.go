@@ -0,0 +1,164 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/goleak"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseUpstreamRouter(t *testing.T) {
+	upstreams := `[
+		{"name": "shop-api", "baseurl": "http://shop:8080/", "hosts": ["api.shop.com"], "path-prefix": "/v1"},
+		{"name": "shop", "baseurl": "http://shop:80", "hosts": ["shop.com", "*.shop.com"]},
+		{"name": "orders", "baseurl": "http://orders:8080", "path-prefix": "/orders"}
+	]`
+	defaultUpstream, err := NewUpstream(UpstreamDefault, []string{"http://backend"}, BalanceRoundRobin, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := ParseUpstreamRouter(upstreams, defaultUpstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router.Upstreams[0].Instances[0].BaseURL != "http://shop:8080" {
+		t.Errorf("Expect trailing slash removed but %s", router.Upstreams[0].Instances[0].BaseURL)
+	}
+
+	testData := []struct {
+		host     string
+		path     string
+		upstream string
+	}{
+		{"api.shop.com", "/v1/products", "shop-api"},
+		{"API.SHOP.COM:443", "/v1/products", "shop-api"},
+		{"api.shop.com", "/v2/products", "shop"},
+		{"shop.com", "/orders/1", "shop"},
+		{"www.shop.com", "/", "shop"},
+		{"myshop.com", "/", UpstreamDefault},
+		{"localhost", "/orders/1", "orders"},
+		{"localhost", "/order", UpstreamDefault},
+		{"localhost", "/orders", "orders"},
+		{"localhost", "/ordersv2/1", UpstreamDefault},
+		{"localhost", "/orders-internal/1", UpstreamDefault},
+	}
+	for _, td := range testData {
+		req := httptest.NewRequest("GET", "http://"+td.host+td.path, nil)
+		if upstream := router.Match(req); upstream.Name != td.upstream {
+			t.Errorf("Expect %s%s to go to %s but %s", td.host, td.path, td.upstream, upstream.Name)
+		}
+	}
+	if key := router.Upstreams[2].Namespace("/orders/1"); key != "[orders]/orders/1" {
+		t.Errorf("Unexpected namespaced key %s", key)
+	}
+	if key := router.Default.Namespace("/orders/1"); key != "/orders/1" {
+		t.Errorf("Expect default upstream not to be namespaced but %s", key)
+	}
+
+	for _, invalid := range []string{
+		`[{"baseurl": "http://shop", "hosts": ["shop.com"]}]`,
+		`[{"name": "default", "baseurl": "http://shop", "hosts": ["shop.com"]}]`,
+		`[{"name": "shop", "hosts": ["shop.com"]}]`,
+		`[{"name": "shop", "baseurl": "http://shop"}]`,
+		`[{"name": "shop", "baseurl": "http://shop", "path-prefix": "/a"}, {"name": "shop", "baseurl": "http://shop", "path-prefix": "/b"}]`,
+		`[{"name": "shop", "baseurls": ["http://shop1", "http://shop2"], "balancer": "random", "path-prefix": "/a"}]`,
+	} {
+		if _, err := ParseUpstreamRouter(invalid, defaultUpstream); err == nil {
+			t.Errorf("Expect error for %s", invalid)
+		}
+	}
+}
+
+func TestUpstreamRouting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	newBackend := func(name string, fail *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if atomic.LoadInt32(fail) == 1 {
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+			res.Write([]byte(name + " " + req.URL.Path))
+		}))
+	}
+	var shopFail, ordersFail, defaultFail int32
+	shop := newBackend("shop", &shopFail)
+	defer shop.Close()
+	orders := newBackend("orders", &ordersFail)
+	defer orders.Close()
+	backend := newBackend("default", &defaultFail)
+	defer backend.Close()
+
+	Config[BackendURL] = backend.URL
+	Config[Upstreams] = fmt.Sprintf(`[
+		{"name": "shop", "baseurl": "%s", "hosts": ["shop.com"]},
+		{"name": "orders", "baseurl": "%s", "path-prefix": "/orders"}
+	]`, shop.URL, orders.URL)
+	defer func() {
+		Config[Upstreams] = ""
+	}()
+	handler := NewRetterHTTPHandler()
+	defer handler.Close()
+
+	call := func(host, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", "http://"+host+path, nil))
+		return resp
+	}
+	for host, expected := range map[string]string{"shop.com": "shop /orders/1", "localhost": "orders /orders/1", "other.com": "default /other"} {
+		path := "/orders/1"
+		if host == "other.com" {
+			path = "/other"
+		}
+		if resp := call(host, path); resp.Body.String() != expected {
+			t.Errorf("Expect %s but %s", expected, resp.Body.String())
+		}
+	}
+
+	// the same path of different upstreams are cached separately
+	if handler.Cache.Get("[shop]/orders/1", false, 0) == nil || handler.Cache.Get("[orders]/orders/1", false, 0) == nil || handler.Cache.Get("/other", false, 0) == nil {
+		t.Errorf("Expect each upstream to have its own cache namespace")
+	}
+
+	// breakers of a failing upstream do not affect other upstreams
+	atomic.StoreInt32(&ordersFail, 1)
+	for i := 0; i < 7; i++ {
+		call("localhost", "/orders/1")
+	}
+	if resp := call("localhost", "/orders/1"); resp.Header().Get("X-Circuit") != "OPEN; level=key" || resp.Body.String() != "orders /orders/1" {
+		t.Errorf("Expect orders breaker to open and serve from cache but %s - %s", resp.Header().Get("X-Circuit"), resp.Body.String())
+	}
+	if resp := call("shop.com", "/orders/1"); resp.Header().Get("X-Circuit") != "CLOSED" || resp.Header().Get("X-Retter") != "backend" {
+		t.Errorf("Expect shop breaker to stay closed but %s - %s", resp.Header().Get("X-Circuit"), resp.Header().Get("X-Retter"))
+	}
+
+	health := &HealthStatus{}
+	if err := json.Unmarshal(MakeCall("GET", "/health", t, handler).Body.Bytes(), health); err != nil {
+		t.Fatal(err)
+	}
+	if len(health.Upstreams) != 3 || health.Upstreams[2].Name != UpstreamDefault || health.BreakerCount != 3 {
+		t.Errorf("Unexpected upstreams health %v", health.Upstreams)
+	}
+}
@@ -19,6 +19,7 @@
 package cache
 
 import (
+	"container/heap"
 	"github.com/sirupsen/logrus"
 	"sync"
 	"time"
@@ -29,98 +30,324 @@ var (
 		"module": "Cache",
 		"file":   "cache/Caching.go",
 	})
-	cacheData = make(map[string]interface{})
-	timerData = make(map[string]*time.Timer)
-	mutext    sync.Mutex
 )
 
-// CacheSize return the size of this cache
-func CacheSize() int {
-	return len(cacheData)
+// NewMemoryStore creates a new unbounded Store that keeps its entries in process memory.
+func NewMemoryStore() *MemoryStore {
+	return NewBoundedMemoryStore(EvictNone, 0, 0)
+}
+
+// NewBoundedMemoryStore creates a new Store that keeps its entries in process memory.
+// Once the number of entries reach maxEntries or the total size of entries reach maxBytes,
+// entries will be evicted according to the eviction policy. Zero maxEntries or maxBytes means unlimited.
+func NewBoundedMemoryStore(policy string, maxEntries int, maxBytes int64) *MemoryStore {
+	return NewMemoryStoreWithOptions(Options{EvictionPolicy: policy, MaxEntries: maxEntries, MaxBytes: maxBytes})
+}
+
+// NewMemoryStoreWithOptions creates a new Store that keeps its entries in process memory,
+// bounded by the eviction policy, max entries and max bytes of the options.
+func NewMemoryStoreWithOptions(opts Options) *MemoryStore {
+	ms := &MemoryStore{
+		cacheData:  make(map[string]*memoryEntry),
+		maxEntries: opts.MaxEntries,
+		maxBytes:   opts.MaxBytes,
+		onEvict:    opts.OnEvict,
+		wake:       make(chan bool, 1),
+		stop:       make(chan bool),
+	}
+	if opts.MaxEntries > 0 || opts.MaxBytes > 0 {
+		ms.policy = newEvictionPolicy(opts.EvictionPolicy)
+	}
+	ms.wait.Add(1)
+	go ms.janitor()
+	return ms
+}
+
+// MemoryStore is the default Store implementation. Entries are kept in a map, and those with TTL
+// are also kept in a min-heap ordered by their expiry time. A single janitor goroutine removes
+// the entries from the top of the heap as they expire. Expired entries that are read before
+// the janitor gets to them are removed on read.
+type MemoryStore struct {
+	cacheData map[string]*memoryEntry
+	expiry    expiryHeap
+	mutext    sync.Mutex
+
+	policy      evictionPolicy
+	maxEntries  int
+	maxBytes    int64
+	bytes       int64
+	evictions   uint64
+	expirations uint64
+	rejected    uint64
+	onEvict     func(key string)
+
+	wake chan bool
+	stop chan bool
+	wait sync.WaitGroup
+	once sync.Once
+}
+
+// Size return the size of this cache
+func (ms *MemoryStore) Size() int {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	return len(ms.cacheData)
+}
+
+// ExpirySize return the number of entries waiting to expire
+func (ms *MemoryStore) ExpirySize() int {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	return len(ms.expiry)
 }
 
-// TimerSize return the size of timer
-func TimerSize() int {
-	return len(timerData)
+// Stats return the statistic of this cache
+func (ms *MemoryStore) Stats() Stats {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	return Stats{
+		Entries:     len(ms.cacheData),
+		Bytes:       ms.bytes,
+		Evictions:   ms.evictions,
+		Expirations: ms.expirations,
+		Rejected:    ms.rejected,
+	}
 }
 
 // Clear the cache
-func Clear() {
-	mutext.Lock()
-	defer mutext.Unlock()
+func (ms *MemoryStore) Clear() {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
 
-	dataKeys := make([]string, len(cacheData))
-	index := 0
-	for k, _ := range cacheData {
-		dataKeys[index] = k
-		index++
+	ms.cacheData = make(map[string]*memoryEntry)
+	ms.expiry = nil
+	if ms.policy != nil {
+		ms.policy.clear()
 	}
-	for _, v := range dataKeys {
-		delete(cacheData, v)
+	ms.bytes = 0
+}
+
+// Set a value into cache identified by the key. It also specify the TTL duration.
+// If the store is bounded, other entries might get evicted to make room for this one.
+func (ms *MemoryStore) Set(key string, value interface{}, ttl time.Duration) {
+	var evicted []string
+	defer func() {
+		ms.notifyEvicted(evicted)
+	}()
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	// replacing an entry is treated as removing the old one and adding a new one
+	_, replaced := ms.cacheData[key]
+	ms.remove(key)
+
+	size := SizeOf(value)
+	if ms.maxBytes > 0 && size > ms.maxBytes {
+		log.Debugf("value for key %s is %d bytes, larger than the cache limit of %d bytes", key, size, ms.maxBytes)
+		ms.rejected++
+		// the old entry is gone without a new one to take its place
+		if replaced {
+			evicted = append(evicted, key)
+		}
+		return
 	}
+	evicted = ms.evict(1, size)
 
-	timerKeys := make([]string, len(timerData))
-	index = 0
-	for k, _ := range timerData {
-		timerKeys[index] = k
-		index++
+	entry := &memoryEntry{
+		key:         key,
+		value:       value,
+		size:        size,
+		stored:      time.Now(),
+		expiryIndex: -1,
 	}
-	for _, v := range timerKeys {
-		delete(timerData, v)
+	ms.cacheData[key] = entry
+	ms.bytes += size
+	if ms.policy != nil {
+		ms.policy.added(entry)
 	}
+	ms.expireIn(entry, ttl)
 }
 
-// Store a value into cache identified by the key. It also specify the TTL duration
-func Store(key string, value interface{}, ttl time.Duration) {
-	mutext.Lock()
-	defer mutext.Unlock()
-
-	cacheData[key] = value
-	if timer, ok := timerData[key]; ok {
-		if !timer.Stop() {
-			<-timer.C
+// expireIn (re)schedule the entry to expire after ttl. Caller must hold the lock.
+func (ms *MemoryStore) expireIn(entry *memoryEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		entry.expires = time.Time{}
+		if entry.expiryIndex >= 0 {
+			heap.Remove(&ms.expiry, entry.expiryIndex)
 		}
-		timer.Reset(ttl)
+		return
+	}
+	entry.expires = time.Now().Add(ttl)
+	if entry.expiryIndex >= 0 {
+		heap.Fix(&ms.expiry, entry.expiryIndex)
 	} else {
-		timerData[key] = time.AfterFunc(ttl, func() {
-			mutext.Lock()
-			defer mutext.Unlock()
+		heap.Push(&ms.expiry, entry)
+	}
+	if entry.expiryIndex == 0 {
+		// the earliest expiry has changed, let the janitor know.
+		select {
+		case ms.wake <- true:
+		default:
+		}
+	}
+}
 
-			delete(cacheData, key)
-			delete(timerData, key)
-		})
+// evict entries until the store have a room for additional entries and bytes. Return the evicted keys.
+func (ms *MemoryStore) evict(entries int, bytes int64) (evicted []string) {
+	if ms.policy == nil {
+		return nil
+	}
+	for (ms.maxEntries > 0 && len(ms.cacheData)+entries > ms.maxEntries) || (ms.maxBytes > 0 && ms.bytes+bytes > ms.maxBytes) {
+		victim := ms.policy.victim()
+		if victim == nil {
+			return evicted
+		}
+		ms.remove(victim.key)
+		ms.evictions++
+		evicted = append(evicted, victim.key)
+	}
+	return evicted
+}
+
+// notifyEvicted call the OnEvict of the store with the evicted keys. Caller must not hold the lock.
+func (ms *MemoryStore) notifyEvicted(keys []string) {
+	if ms.onEvict == nil {
+		return
+	}
+	for _, key := range keys {
+		ms.onEvict(key)
+	}
+}
+
+// remove an entry from the map, the expiry heap and the eviction policy. Caller must hold the lock.
+func (ms *MemoryStore) remove(key string) {
+	if entry, ok := ms.cacheData[key]; ok {
+		if ms.policy != nil {
+			ms.policy.removed(entry)
+		}
+		if entry.expiryIndex >= 0 {
+			heap.Remove(&ms.expiry, entry.expiryIndex)
+		}
+		ms.bytes -= entry.size
+		delete(ms.cacheData, key)
 	}
 }
 
 // Get a value from cache identified by the key. It also specify new TTL duration if it need to reset
-func Get(key string, reset bool, ttl time.Duration) interface{} {
-	mutext.Lock()
-	defer mutext.Unlock()
-
-	if value, ok := cacheData[key]; ok {
-		if timer, ok := timerData[key]; ok && reset {
-			if !timer.Stop() {
-				<-timer.C
-			}
-			timer.Reset(ttl)
+func (ms *MemoryStore) Get(key string, reset bool, ttl time.Duration) interface{} {
+	var expired []string
+	defer func() {
+		ms.notifyEvicted(expired)
+	}()
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	if entry, ok := ms.cacheData[key]; ok {
+		if entry.expired(time.Now()) {
+			ms.remove(key)
+			ms.expirations++
+			expired = []string{key}
+			return nil
+		}
+		if reset {
+			ms.expireIn(entry, ttl)
+		}
+		if ms.policy != nil {
+			ms.policy.accessed(entry)
 		}
-		return value
+		return entry.value
 	}
 	return nil
 }
 
-// Remove a cache entry
-func Remove(key string) {
-	mutext.Lock()
-	defer mutext.Unlock()
+// Entries return the description of every non expired entry in this cache
+func (ms *MemoryStore) Entries() []EntryInfo {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
 
-	if timer, ok := timerData[key]; ok {
-		if !timer.Stop() {
-			<-timer.C
+	now := time.Now()
+	infos := make([]EntryInfo, 0, len(ms.cacheData))
+	for key, entry := range ms.cacheData {
+		if entry.expired(now) {
+			continue
 		}
-		delete(timerData, key)
+		infos = append(infos, EntryInfo{
+			Key:     key,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+			Size:    entry.size,
+		})
 	}
-	if _, ok := cacheData[key]; ok {
-		delete(cacheData, key)
+	return infos
+}
+
+// Delete a cache entry
+func (ms *MemoryStore) Delete(key string) {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	ms.remove(key)
+}
+
+// removeExpired removes all expired entries and return the time of the next expiry,
+// or zero time if there's no entry to expire, with the removed keys.
+func (ms *MemoryStore) removeExpired() (time.Time, []string) {
+	ms.mutext.Lock()
+	defer ms.mutext.Unlock()
+
+	now := time.Now()
+	var expired []string
+	for len(ms.expiry) > 0 {
+		next := ms.expiry[0]
+		if !next.expired(now) {
+			return next.expires, expired
+		}
+		ms.remove(next.key)
+		ms.expirations++
+		expired = append(expired, next.key)
 	}
+	return time.Time{}, expired
+}
+
+// janitor removes the expired entries, sleeping until the next entry is due to expire.
+func (ms *MemoryStore) janitor() {
+	defer ms.wait.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		next, expired := ms.removeExpired()
+		ms.notifyEvicted(expired)
+		sleep := time.Hour
+		if !next.IsZero() {
+			sleep = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(sleep)
+
+		select {
+		case <-timer.C:
+		case <-ms.wake:
+		case <-ms.stop:
+			return
+		}
+	}
+}
+
+// Close stops the janitor goroutine and removes all entries.
+func (ms *MemoryStore) Close() error {
+	ms.once.Do(func() {
+		close(ms.stop)
+		ms.wait.Wait()
+		ms.Clear()
+	})
+	return nil
 }
@@ -21,6 +21,8 @@ package cache
 import (
 	"fmt"
 	"go.uber.org/goleak"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -28,18 +30,21 @@ import (
 func TestCacheNoReset(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	Store("akey", "avalue", 2*time.Second)
-	val := Get("akey", false, 0)
+	store := NewMemoryStore()
+	defer store.Close()
+
+	store.Set("akey", "avalue", 2*time.Second)
+	val := store.Get("akey", false, 0)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
 	time.Sleep(1 * time.Second)
-	val = Get("akey", false, 0)
+	val = store.Get("akey", false, 0)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
 	time.Sleep(2 * time.Second)
-	val = Get("akey", false, 0)
+	val = store.Get("akey", false, 0)
 	if val != nil {
 		t.Errorf("Expect nil but \"%s\"", val.(string))
 	}
@@ -48,26 +53,27 @@ func TestCacheNoReset(t *testing.T) {
 func TestWriteReadRemove(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	Clear()
+	store := NewMemoryStore()
+	defer store.Close()
 
-	if CacheSize() != 0 {
-		t.Errorf("Excpect cache size = 0 but %d", CacheSize())
+	if store.Size() != 0 {
+		t.Errorf("Excpect cache size = 0 but %d", store.Size())
 	}
-	if TimerSize() != 0 {
-		t.Errorf("Excpect timer size = 0 but %d", TimerSize())
+	if store.ExpirySize() != 0 {
+		t.Errorf("Excpect expiry size = 0 but %d", store.ExpirySize())
 	}
 
 	tmr := time.Now()
 	for i := 0; i < 5000; i++ {
 		k := fmt.Sprintf("K%d", i)
 		v := fmt.Sprintf("V%d", i)
-		Store(k, v, 2*time.Second)
-		vget := Get(k, false, 0)
+		store.Set(k, v, 2*time.Second)
+		vget := store.Get(k, false, 0)
 		if vget.(string) != v {
 			t.Errorf("expect equals %s, but %s", v, vget)
 		}
 		if i >= 3000 {
-			Remove(k)
+			store.Delete(k)
 		}
 	}
 	if (time.Since(tmr) / time.Millisecond) >= (2000 * time.Millisecond) {
@@ -76,40 +82,42 @@ func TestWriteReadRemove(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	if CacheSize() != TimerSize() {
-		t.Fatalf("Cache %d != Timer %d", CacheSize(), TimerSize())
+	if store.Size() != store.ExpirySize() {
+		t.Fatalf("Cache %d != Expiry %d", store.Size(), store.ExpirySize())
 	}
-	if CacheSize() != 3000 {
-		t.Fatalf("Excpect cache size = 3000 but %d", CacheSize())
+	if store.Size() != 3000 {
+		t.Fatalf("Excpect cache size = 3000 but %d", store.Size())
 	}
-	if TimerSize() != 3000 {
-		t.Fatalf("Excpect timer size = 3000 but %d", TimerSize())
+	if store.ExpirySize() != 3000 {
+		t.Fatalf("Excpect expiry size = 3000 but %d", store.ExpirySize())
 	}
 
 	time.Sleep(2 * time.Second)
 
-	if CacheSize() != TimerSize() {
-		t.Fatalf("Cache %d != Timer %d", CacheSize(), TimerSize())
+	if store.Size() != store.ExpirySize() {
+		t.Fatalf("Cache %d != Expiry %d", store.Size(), store.ExpirySize())
 	}
-	if CacheSize() != 0 {
-		t.Fatalf("Excpect cache size = 3000 but %d", CacheSize())
+	if store.Size() != 0 {
+		t.Fatalf("Excpect cache size = 3000 but %d", store.Size())
 	}
-	if TimerSize() != 0 {
-		t.Fatalf("Excpect timer size = 3000 but %d", TimerSize())
+	if store.ExpirySize() != 0 {
+		t.Fatalf("Excpect expiry size = 3000 but %d", store.ExpirySize())
 	}
 }
 
 func BenchmarkCache(b *testing.B) {
+	store := NewMemoryStore()
+	defer store.Close()
 	for i := 0; i < b.N; i++ {
 		k := fmt.Sprintf("K%d", i)
 		v := fmt.Sprintf("V%d", i)
-		Store(k, v, 2*time.Second)
-		vget := Get(k, false, 0)
+		store.Set(k, v, 2*time.Second)
+		vget := store.Get(k, false, 0)
 		if vget.(string) != v {
 			b.Errorf("expect equals %s, but %s", v, vget)
 		}
 		if i >= 3000 {
-			Remove(k)
+			store.Delete(k)
 		}
 	}
 }
@@ -117,50 +125,340 @@ func BenchmarkCache(b *testing.B) {
 func TestCacheWithReset(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	Clear()
+	store := NewMemoryStore()
+	defer store.Close()
 
-	if CacheSize() != 0 {
-		t.Errorf("Excpect cache size = 0 but %d", CacheSize())
+	if store.Size() != 0 {
+		t.Errorf("Excpect cache size = 0 but %d", store.Size())
 	}
-	if TimerSize() != 0 {
-		t.Errorf("Excpect timer size = 0 but %d", TimerSize())
+	if store.ExpirySize() != 0 {
+		t.Errorf("Excpect expiry size = 0 but %d", store.ExpirySize())
 	}
 
-	Store("akey", "avalue", 1*time.Second)
-	val := Get("akey", false, 0)
+	store.Set("akey", "avalue", 1*time.Second)
+	val := store.Get("akey", false, 0)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
 	time.Sleep(500 * time.Millisecond)
-	val = Get("akey", true, 1*time.Second)
+	val = store.Get("akey", true, 1*time.Second)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
 	time.Sleep(500 * time.Millisecond)
-	val = Get("akey", true, 1*time.Second)
+	val = store.Get("akey", true, 1*time.Second)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
-	if CacheSize() != 1 {
-		t.Errorf("Excpect cache size = 1 but %d", CacheSize())
+	if store.Size() != 1 {
+		t.Errorf("Excpect cache size = 1 but %d", store.Size())
 	}
-	if TimerSize() != 1 {
-		t.Errorf("Excpect timer size = 1 but %d", TimerSize())
+	if store.ExpirySize() != 1 {
+		t.Errorf("Excpect expiry size = 1 but %d", store.ExpirySize())
 	}
 	time.Sleep(500 * time.Millisecond)
-	val = Get("akey", false, 0)
+	val = store.Get("akey", false, 0)
 	if val.(string) != "avalue" {
 		t.Errorf("Expect \"avalue\" but \"%s\"", val.(string))
 	}
 	time.Sleep(600 * time.Millisecond)
-	if CacheSize() != 0 {
-		t.Errorf("Excpect cache size = 0 but %d", CacheSize())
+	if store.Size() != 0 {
+		t.Errorf("Excpect cache size = 0 but %d", store.Size())
 	}
-	if TimerSize() != 0 {
-		t.Errorf("Excpect timer size = 0 but %d", TimerSize())
+	if store.ExpirySize() != 0 {
+		t.Errorf("Excpect expiry size = 0 but %d", store.ExpirySize())
 	}
-	val = Get("akey", false, 0)
+	val = store.Get("akey", false, 0)
 	if val != nil {
 		t.Errorf("Expect nil but \"%s\"", val.(string))
 	}
 }
+
+func TestNewStore(t *testing.T) {
+	store, err := NewStore("Memory", Options{})
+	if err != nil {
+		t.Fatalf("Expect memory store to be registered but got %s", err.Error())
+	}
+	defer store.Close()
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Errorf("Expect *MemoryStore but %T", store)
+	}
+	if _, err := NewStore("unknown", Options{}); err == nil {
+		t.Errorf("Expect error for unregistered store")
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	store := NewBoundedMemoryStore(EvictLRU, 3, 0)
+	defer store.Close()
+
+	store.Set("a", "A", time.Minute)
+	store.Set("b", "B", time.Minute)
+	store.Set("c", "C", time.Minute)
+
+	// touch "a" so "b" becomes the least recently used
+	store.Get("a", false, 0)
+	store.Set("d", "D", time.Minute)
+
+	if store.Size() != 3 {
+		t.Fatalf("Expect cache size = 3 but %d", store.Size())
+	}
+	if store.Get("b", false, 0) != nil {
+		t.Errorf("Expect \"b\" to be evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if store.Get(k, false, 0) == nil {
+			t.Errorf("Expect \"%s\" to be kept", k)
+		}
+	}
+	if store.Stats().Evictions != 1 {
+		t.Errorf("Expect 1 eviction but %d", store.Stats().Evictions)
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	store := NewBoundedMemoryStore(EvictLFU, 3, 0)
+	defer store.Close()
+
+	store.Set("a", "A", time.Minute)
+	store.Set("b", "B", time.Minute)
+	store.Set("c", "C", time.Minute)
+	for i := 0; i < 3; i++ {
+		store.Get("a", false, 0)
+		store.Get("c", false, 0)
+	}
+	store.Get("b", false, 0)
+	store.Set("d", "D", time.Minute)
+
+	if store.Get("b", false, 0) != nil {
+		t.Errorf("Expect \"b\" to be evicted")
+	}
+	// "d" is now the least frequently used
+	store.Set("e", "E", time.Minute)
+	if store.Get("d", false, 0) != nil {
+		t.Errorf("Expect \"d\" to be evicted")
+	}
+	if store.Size() != 3 {
+		t.Fatalf("Expect cache size = 3 but %d", store.Size())
+	}
+}
+
+func TestBoundedFlood(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	maxBytes := int64(64 * 1024)
+	store := NewBoundedMemoryStore(EvictLRU, 1000, maxBytes)
+	defer store.Close()
+
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 100000; i++ {
+		store.Set(fmt.Sprintf("/path?q=%d", i), value, time.Minute)
+		stats := store.Stats()
+		if stats.Bytes > maxBytes || stats.Entries > 1000 {
+			t.Fatalf("Store exceeds its limit with %d entries and %d bytes", stats.Entries, stats.Bytes)
+		}
+	}
+	stats := store.Stats()
+	if stats.Entries != 65 || stats.Bytes != 65000 {
+		t.Errorf("Expect 65 entries of 65000 bytes but %d entries of %d bytes", stats.Entries, stats.Bytes)
+	}
+	if stats.Evictions != 100000-65 {
+		t.Errorf("Expect %d evictions but %d", 100000-65, stats.Evictions)
+	}
+
+	store.Set("huge", strings.Repeat("x", int(maxBytes)+1), time.Minute)
+	if store.Get("huge", false, 0) != nil || store.Stats().Rejected != 1 {
+		t.Errorf("Expect value larger than the limit to be rejected")
+	}
+}
+
+func TestExpiryOnReadAndClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	store := NewMemoryStore()
+	store.Set("short", "SHORT", 50*time.Millisecond)
+	store.Set("long", "LONG", time.Hour)
+	store.Set("forever", "FOREVER", 0)
+
+	// take the lock so the janitor can not remove the entry before we read it
+	store.mutext.Lock()
+	store.cacheData["short"].expires = time.Now().Add(-time.Millisecond)
+	store.mutext.Unlock()
+	if val := store.Get("short", true, time.Hour); val != nil {
+		t.Errorf("Expect expired entry to be removed on read but %v", val)
+	}
+	if store.ExpirySize() != 1 || store.Size() != 2 {
+		t.Errorf("Expect 1 entry waiting to expire out of 2 but %d of %d", store.ExpirySize(), store.Size())
+	}
+
+	// resetting into zero TTL makes the entry never expire
+	store.Get("long", true, 0)
+	if store.ExpirySize() != 0 {
+		t.Errorf("Expect no entry waiting to expire but %d", store.ExpirySize())
+	}
+	if store.Stats().Expirations != 1 {
+		t.Errorf("Expect 1 expiration but %d", store.Stats().Expirations)
+	}
+
+	store.Close()
+	store.Close()
+	if store.Size() != 0 {
+		t.Errorf("Expect closed store to be empty but %d", store.Size())
+	}
+}
+
+// timerStore is the previous MemoryStore design, where each key have its own time.AfterFunc timer.
+// It is kept here to benchmark against the current design.
+type timerStore struct {
+	cacheData map[string]interface{}
+	timerData map[string]*time.Timer
+	mutext    sync.Mutex
+}
+
+func (ts *timerStore) Set(key string, value interface{}, ttl time.Duration) {
+	ts.mutext.Lock()
+	defer ts.mutext.Unlock()
+
+	ts.cacheData[key] = value
+	if timer, ok := ts.timerData[key]; ok {
+		timer.Stop()
+		timer.Reset(ttl)
+	} else {
+		ts.timerData[key] = time.AfterFunc(ttl, func() {
+			ts.mutext.Lock()
+			defer ts.mutext.Unlock()
+
+			delete(ts.cacheData, key)
+			delete(ts.timerData, key)
+		})
+	}
+}
+
+func (ts *timerStore) Get(key string) interface{} {
+	ts.mutext.Lock()
+	defer ts.mutext.Unlock()
+
+	return ts.cacheData[key]
+}
+
+func (ts *timerStore) Clear() {
+	ts.mutext.Lock()
+	defer ts.mutext.Unlock()
+
+	for _, timer := range ts.timerData {
+		timer.Stop()
+	}
+	ts.cacheData = make(map[string]interface{})
+	ts.timerData = make(map[string]*time.Timer)
+}
+
+func BenchmarkTimerStore100k(b *testing.B) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("K%d", i)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		store := &timerStore{
+			cacheData: make(map[string]interface{}),
+			timerData: make(map[string]*time.Timer),
+		}
+		for i, k := range keys {
+			store.Set(k, k, time.Minute+time.Duration(i)*time.Millisecond)
+		}
+		for _, k := range keys {
+			store.Get(k)
+		}
+		store.Clear()
+	}
+}
+
+func BenchmarkMemoryStore100k(b *testing.B) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("K%d", i)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		store := NewMemoryStore()
+		for i, k := range keys {
+			store.Set(k, k, time.Minute+time.Duration(i)*time.Millisecond)
+		}
+		for _, k := range keys {
+			store.Get(k, false, 0)
+		}
+		store.Close()
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	evicted := make(chan string, 10)
+	store := NewMemoryStoreWithOptions(Options{
+		EvictionPolicy: EvictLRU,
+		MaxEntries:     2,
+		OnEvict: func(key string) {
+			evicted <- key
+		},
+	})
+	defer store.Close()
+
+	store.Set("a", "A", 0)
+	store.Set("b", "B", 50*time.Millisecond)
+	store.Set("a", "AA", 0)
+	store.Delete("a")
+	store.Set("c", "C", 0)
+	store.Set("d", "D", 0)
+	if key := <-evicted; key != "b" {
+		t.Errorf("Expect \"b\" evicted but %s", key)
+	}
+
+	store.Set("e", "E", 50*time.Millisecond)
+	select {
+	case key := <-evicted:
+		if key != "c" {
+			t.Errorf("Expect \"c\" evicted but %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expect \"c\" evicted")
+	}
+	select {
+	case key := <-evicted:
+		if key != "e" {
+			t.Errorf("Expect \"e\" expired but %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect \"e\" expired")
+	}
+	if len(evicted) != 0 {
+		t.Errorf("Expect replaced and deleted entries not to be notified but %s", <-evicted)
+	}
+}
+
+func TestOnEvictRejected(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var evicted []string
+	store := NewMemoryStoreWithOptions(Options{
+		MaxBytes: 4,
+		OnEvict: func(key string) {
+			evicted = append(evicted, key)
+		},
+	})
+	defer store.Close()
+
+	store.Set("a", "A", 0)
+	store.Set("a", "too large", 0)
+	store.Set("b", "too large", 0)
+	if store.Get("a", false, 0) != nil {
+		t.Errorf("Expect the replaced entry removed")
+	}
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("Expect only \"a\" evicted but %v", evicted)
+	}
+}
@@ -0,0 +1,494 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DiskStoreName is the name of the store that persist its entries on disk.
+	DiskStoreName = "disk"
+
+	diskFileExtension = ".entry"
+)
+
+func init() {
+	RegisterStore(DiskStoreName, func(opts Options) (Store, error) {
+		return NewDiskStore(opts)
+	})
+}
+
+// Codec converts a stored value into bytes and back. Stores that keep their entries
+// outside of process memory need a Codec to serialize the values.
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// diskMeta is the first line of each entry file.
+type diskMeta struct {
+	Key     string    `json:"key"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+	Size    int64     `json:"size"`
+
+	// element of the entry in the recently used order of the store
+	element *list.Element
+}
+
+// expired check whether the entry is already expired. Zero expires never expire.
+func (meta *diskMeta) expired(now time.Time) bool {
+	return !meta.Expires.IsZero() && !now.Before(meta.Expires)
+}
+
+// NewDiskStore creates a new Store that persist each entry into its own file under opts.Dir.
+// Entries already in the directory are loaded, honoring their remaining TTL.
+// Once the number of entries on disk reach opts.MaxEntries or their total size reach opts.MaxBytes,
+// the least recently used entries are removed from disk, unless the eviction policy is EvictNone.
+// Recently used entries are also kept in a memory store bounded by opts, the rest are read from disk when needed.
+func NewDiskStore(opts Options) (*DiskStore, error) {
+	if opts.Codec == nil {
+		return nil, fmt.Errorf("disk store requires a codec")
+	}
+	if len(opts.Dir) == 0 {
+		return nil, fmt.Errorf("disk store requires a directory")
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	ds := &DiskStore{
+		dir:     opts.Dir,
+		codec:   opts.Codec,
+		mem:     NewBoundedMemoryStore(opts.EvictionPolicy, opts.MaxEntries, opts.MaxBytes),
+		index:   make(map[string]*diskMeta),
+		order:   list.New(),
+		onEvict: opts.OnEvict,
+		stop:    make(chan bool),
+	}
+	if strings.ToLower(opts.EvictionPolicy) != EvictNone {
+		ds.maxEntries = opts.MaxEntries
+		ds.maxBytes = opts.MaxBytes
+	}
+	if err := ds.load(); err != nil {
+		return nil, err
+	}
+	interval := opts.CompactInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ds.wait.Add(1)
+	go ds.compactor(interval)
+	return ds, nil
+}
+
+// DiskStore is a Store that persist its entries on disk so they survive restarts.
+type DiskStore struct {
+	dir   string
+	codec Codec
+	mem   *MemoryStore
+	index map[string]*diskMeta
+	mutex sync.Mutex
+
+	// order of the entries on disk, most recently used at the front
+	order      *list.List
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	evictions  uint64
+	rejected   uint64
+	onEvict    func(key string)
+
+	stop chan bool
+	wait sync.WaitGroup
+	once sync.Once
+}
+
+func (ds *DiskStore) fileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.dir, hex.EncodeToString(hash[:])+diskFileExtension)
+}
+
+// load the index of all non expired entries in the directory, and remove the expired ones.
+func (ds *DiskStore) load() error {
+	files, err := filepath.Glob(filepath.Join(ds.dir, "*"+diskFileExtension))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	metas := make([]*diskMeta, 0, len(files))
+	for _, file := range files {
+		meta, _, err := ds.readFile(file, false)
+		if err != nil {
+			log.Warnf("removing unreadable cache file %s. got %s", file, err.Error())
+			os.Remove(file)
+			continue
+		}
+		if meta.expired(now) {
+			os.Remove(file)
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	// the most recently stored entries are kept when the directory holds more than the limits
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Stored.Before(metas[j].Stored)
+	})
+	for _, meta := range metas {
+		ds.evict(meta.Size)
+		ds.addEntry(meta)
+	}
+	log.Debugf("loaded %d cache entries from %s", len(ds.index), ds.dir)
+	return nil
+}
+
+// readFile read the meta and, if withValue is true, the encoded value of an entry file.
+func (ds *DiskStore) readFile(file string, withValue bool) (*diskMeta, []byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &diskMeta{}
+	if err := json.Unmarshal(line, meta); err != nil {
+		return nil, nil, err
+	}
+	if !withValue {
+		return meta, nil, nil
+	}
+	data, err := ioutil.ReadAll(reader)
+	return meta, data, err
+}
+
+// writeFile write the entry into a temporary file and then move it into place,
+// so a crash in the middle of writing will not leave a corrupted entry.
+func (ds *DiskStore) writeFile(meta *diskMeta, data []byte) error {
+	line, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(ds.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(line, '\n')); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ds.fileName(meta.Key))
+}
+
+func expiryOf(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func remainingOf(meta *diskMeta) time.Duration {
+	if meta.Expires.IsZero() {
+		return 0
+	}
+	return time.Until(meta.Expires)
+}
+
+// Set a value into the store and persist it on disk.
+func (ds *DiskStore) Set(key string, value interface{}, ttl time.Duration) {
+	data, err := ds.codec.Encode(value)
+	if err != nil {
+		log.Errorf("can not encode cache value for key %s. got %s", key, err.Error())
+		return
+	}
+
+	var evicted []string
+	defer func() {
+		ds.notifyEvicted(evicted)
+	}()
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	// the old entry is gone without a new one to take its place if the new value is not written
+	_, replaced := ds.index[key]
+	meta := &diskMeta{Key: key, Stored: time.Now(), Expires: expiryOf(ttl), Size: int64(len(data))}
+	if ds.maxBytes > 0 && meta.Size > ds.maxBytes {
+		log.Debugf("value for key %s is %d bytes, larger than the cache limit of %d bytes", key, meta.Size, ds.maxBytes)
+		ds.removeEntry(key)
+		ds.rejected++
+		if replaced {
+			evicted = append(evicted, key)
+		}
+		return
+	}
+	ds.forgetEntry(key)
+	evicted = ds.evict(meta.Size)
+	if err := ds.writeFile(meta, data); err != nil {
+		log.Errorf("can not write cache file for key %s. got %s", key, err.Error())
+		ds.removeEntry(key)
+		if replaced {
+			evicted = append(evicted, key)
+		}
+		return
+	}
+	ds.addEntry(meta)
+	ds.mem.Set(key, value, ttl)
+}
+
+// addEntry add the entry into the index as the most recently used. Caller must hold the lock.
+func (ds *DiskStore) addEntry(meta *diskMeta) {
+	meta.element = ds.order.PushFront(meta.Key)
+	ds.index[meta.Key] = meta
+	ds.bytes += meta.Size
+}
+
+// forgetEntry remove an entry from the index, leaving its file to be overwritten. Caller must hold the lock.
+func (ds *DiskStore) forgetEntry(key string) {
+	if meta, ok := ds.index[key]; ok {
+		ds.order.Remove(meta.element)
+		ds.bytes -= meta.Size
+		delete(ds.index, key)
+	}
+}
+
+// evict the least recently used entries until the store have a room for an entry of size bytes.
+// Return the evicted keys. Caller must hold the lock.
+func (ds *DiskStore) evict(size int64) (evicted []string) {
+	for (ds.maxEntries > 0 && len(ds.index)+1 > ds.maxEntries) || (ds.maxBytes > 0 && ds.bytes+size > ds.maxBytes) {
+		back := ds.order.Back()
+		if back == nil {
+			return evicted
+		}
+		key := back.Value.(string)
+		ds.removeEntry(key)
+		ds.evictions++
+		evicted = append(evicted, key)
+	}
+	return evicted
+}
+
+// notifyEvicted call the OnEvict of the store with the evicted keys. Caller must not hold the lock.
+func (ds *DiskStore) notifyEvicted(keys []string) {
+	if ds.onEvict == nil {
+		return
+	}
+	for _, key := range keys {
+		ds.onEvict(key)
+	}
+}
+
+// Get a value from the store. Values that are not in memory will be read from disk.
+func (ds *DiskStore) Get(key string, reset bool, ttl time.Duration) interface{} {
+	var expired []string
+	defer func() {
+		ds.notifyEvicted(expired)
+	}()
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	meta, ok := ds.index[key]
+	if !ok {
+		return nil
+	}
+	if meta.expired(time.Now()) {
+		ds.removeEntry(key)
+		expired = []string{key}
+		return nil
+	}
+
+	value := ds.mem.Get(key, reset, ttl)
+	var data []byte
+	if value == nil || reset {
+		_, fileData, err := ds.readFile(ds.fileName(key), true)
+		if err != nil {
+			log.Errorf("can not read cache file for key %s. got %s", key, err.Error())
+			ds.removeEntry(key)
+			return nil
+		}
+		data = fileData
+	}
+	if value == nil {
+		decoded, err := ds.codec.Decode(data)
+		if err != nil {
+			log.Errorf("can not decode cache file for key %s. got %s", key, err.Error())
+			ds.removeEntry(key)
+			return nil
+		}
+		value = decoded
+		if reset {
+			ds.mem.Set(key, value, ttl)
+		} else {
+			ds.mem.Set(key, value, remainingOf(meta))
+		}
+	}
+	ds.order.MoveToFront(meta.element)
+	if reset {
+		newMeta := &diskMeta{Key: key, Stored: meta.Stored, Expires: expiryOf(ttl), Size: meta.Size, element: meta.element}
+		if err := ds.writeFile(newMeta, data); err != nil {
+			log.Errorf("can not write cache file for key %s. got %s", key, err.Error())
+		} else {
+			ds.index[key] = newMeta
+		}
+	}
+	return value
+}
+
+// removeEntry remove an entry from memory, index and disk. Caller must hold the lock.
+func (ds *DiskStore) removeEntry(key string) {
+	ds.mem.Delete(key)
+	ds.forgetEntry(key)
+	if err := os.Remove(ds.fileName(key)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("can not remove cache file for key %s. got %s", key, err.Error())
+	}
+}
+
+// Delete an entry from the store and from disk.
+func (ds *DiskStore) Delete(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.removeEntry(key)
+}
+
+// Clear removes all entries from the store and from disk.
+func (ds *DiskStore) Clear() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	for key := range ds.index {
+		ds.removeEntry(key)
+	}
+	ds.mem.Clear()
+}
+
+// Size return the number of entries in the store, including those not kept in memory.
+func (ds *DiskStore) Size() int {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	return len(ds.index)
+}
+
+// Stats return the statistic of the entries on disk. Expirations are those of the entries kept in memory.
+func (ds *DiskStore) Stats() Stats {
+	stats := ds.mem.Stats()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	stats.Entries = len(ds.index)
+	stats.Bytes = ds.bytes
+	stats.Evictions = ds.evictions
+	stats.Rejected = ds.rejected
+	return stats
+}
+
+// Entries return the description of every non expired entry in the store, including those not kept in memory.
+// The size of an entry is the size of its encoded value on disk.
+func (ds *DiskStore) Entries() []EntryInfo {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	now := time.Now()
+	infos := make([]EntryInfo, 0, len(ds.index))
+	for key, meta := range ds.index {
+		if meta.expired(now) {
+			continue
+		}
+		infos = append(infos, EntryInfo{
+			Key:     key,
+			Stored:  meta.Stored,
+			Expires: meta.Expires,
+			Size:    meta.Size,
+		})
+	}
+	return infos
+}
+
+// Compact removes all expired entries from disk.
+func (ds *DiskStore) Compact() {
+	var expired []string
+	defer func() {
+		ds.notifyEvicted(expired)
+	}()
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	now := time.Now()
+	for key, meta := range ds.index {
+		if meta.expired(now) {
+			ds.removeEntry(key)
+			expired = append(expired, key)
+		}
+	}
+
+	// left over from an interrupted write
+	tmps, _ := filepath.Glob(filepath.Join(ds.dir, "tmp-*"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+}
+
+func (ds *DiskStore) compactor(interval time.Duration) {
+	defer ds.wait.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ds.Compact()
+		case <-ds.stop:
+			return
+		}
+	}
+}
+
+// Close stops the compaction of this store. Entries stay on disk to be loaded by the next DiskStore.
+func (ds *DiskStore) Close() error {
+	ds.once.Do(func() {
+		close(ds.stop)
+		ds.wait.Wait()
+		ds.mem.Close()
+	})
+	return nil
+}
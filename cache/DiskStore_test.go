@@ -0,0 +1,208 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package cache
+
+import (
+	"go.uber.org/goleak"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type stringCodec struct{}
+
+func (codec *stringCodec) Encode(value interface{}) ([]byte, error) {
+	return []byte(value.(string)), nil
+}
+
+func (codec *stringCodec) Decode(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func newTestDiskStore(t *testing.T, dir string, maxEntries int) *DiskStore {
+	store, err := NewDiskStore(Options{
+		EvictionPolicy: EvictLRU,
+		MaxEntries:     maxEntries,
+		Dir:            dir,
+		Codec:          &stringCodec{},
+	})
+	if err != nil {
+		t.Fatalf("Can not create disk store. got %s", err.Error())
+	}
+	return store
+}
+
+func TestDiskStoreSurvivesRestart(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newTestDiskStore(t, dir, 0)
+	store.Set("forever", "FOREVER", 0)
+	store.Set("short", "SHORT", 500*time.Millisecond)
+	store.Set("long", "LONG", time.Minute)
+	store.Set("deleted", "DELETED", time.Minute)
+	store.Delete("deleted")
+	store.Close()
+
+	time.Sleep(600 * time.Millisecond)
+
+	store = newTestDiskStore(t, dir, 0)
+	defer store.Close()
+
+	if store.Size() != 2 {
+		t.Errorf("Expect 2 entries to be loaded but %d", store.Size())
+	}
+	for k, v := range map[string]string{"forever": "FOREVER", "long": "LONG"} {
+		if val := store.Get(k, false, 0); val == nil || val.(string) != v {
+			t.Errorf("Expect \"%s\" for key %s but %v", v, k, val)
+		}
+	}
+	if val := store.Get("short", false, 0); val != nil {
+		t.Errorf("Expect expired entry not to be loaded but %v", val)
+	}
+	for _, info := range store.Entries() {
+		if info.Stored.IsZero() || info.Size == 0 || (info.Key == "forever") != info.Expires.IsZero() {
+			t.Errorf("Unexpected entry info %v", info)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskFileExtension))
+	if len(files) != 2 {
+		t.Errorf("Expect 2 files on disk but %d", len(files))
+	}
+}
+
+func TestDiskStoreCompactAndEvict(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newTestDiskStore(t, dir, 0)
+	defer store.Close()
+
+	store.Set("a", "A", 200*time.Millisecond)
+	store.Set("b", "B", time.Minute)
+
+	// "a" is no longer in memory, but must still be served from disk
+	store.mem.Delete("a")
+	if val := store.Get("a", false, 0); val == nil || val.(string) != "A" {
+		t.Errorf("Expect \"A\" from disk but %v", val)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	store.Compact()
+
+	if store.Size() != 1 {
+		t.Errorf("Expect 1 entry after compaction but %d", store.Size())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskFileExtension))
+	if len(files) != 1 {
+		t.Errorf("Expect 1 file on disk after compaction but %d", len(files))
+	}
+
+	store.Clear()
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+diskFileExtension))
+	if store.Size() != 0 || len(files) != 0 {
+		t.Errorf("Expect empty store after clear but %d entries and %d files", store.Size(), len(files))
+	}
+}
+
+func TestDiskStoreBounded(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newTestDiskStore(t, dir, 3)
+	store.Set("a", "A", 0)
+	store.Set("b", "B", 0)
+	store.Set("c", "C", 0)
+	store.Get("a", false, 0)
+	store.Set("d", "D", 0)
+	store.Set("e", "E", 0)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskFileExtension))
+	if store.Size() != 3 || len(files) != 3 {
+		t.Errorf("Expect 3 entries and 3 files but %d entries and %d files", store.Size(), len(files))
+	}
+	for k, expected := range map[string]interface{}{"a": "A", "b": nil, "c": nil, "d": "D", "e": "E"} {
+		if val := store.Get(k, false, 0); val != expected {
+			t.Errorf("Expect %v for key %s but %v", expected, k, val)
+		}
+	}
+	if stats := store.Stats(); stats.Evictions != 2 || stats.Bytes != 3 {
+		t.Errorf("Expect 2 evictions and 3 bytes but %d evictions and %d bytes", stats.Evictions, stats.Bytes)
+	}
+	store.Close()
+
+	// a directory holding more entries than the limit keeps the most recently stored ones
+	store = newTestDiskStore(t, dir, 2)
+	defer store.Close()
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+diskFileExtension))
+	if store.Size() != 2 || len(files) != 2 || store.Get("a", false, 0) != nil || store.Get("e", false, 0) != "E" {
+		t.Errorf("Expect the 2 most recent entries loaded but %d entries and %d files", store.Size(), len(files))
+	}
+}
+
+func TestDiskStoreOnEvictRejected(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := ioutil.TempDir("", "retter-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var evicted []string
+	store, err := NewDiskStore(Options{
+		MaxBytes: 4,
+		Dir:      dir,
+		Codec:    &stringCodec{},
+		OnEvict: func(key string) {
+			evicted = append(evicted, key)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can not create disk store. got %s", err.Error())
+	}
+	defer store.Close()
+
+	store.Set("a", "A", 0)
+	store.Set("a", "too large", 0)
+	store.Set("b", "too large", 0)
+	if store.Get("a", false, 0) != nil {
+		t.Errorf("Expect the replaced entry removed")
+	}
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("Expect only \"a\" evicted but %v", evicted)
+	}
+}
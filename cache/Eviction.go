@@ -0,0 +1,209 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"strings"
+	"time"
+)
+
+const (
+	// EvictNone will never evict entries, the store is unbounded
+	EvictNone = "none"
+
+	// EvictLRU will evict the least recently used entry when the store is full
+	EvictLRU = "lru"
+
+	// EvictLFU will evict the least frequently used entry when the store is full
+	EvictLFU = "lfu"
+)
+
+// memoryEntry is a single entry in the MemoryStore
+type memoryEntry struct {
+	key    string
+	value  interface{}
+	size   int64
+	stored time.Time
+
+	// zero expires never expire
+	expires     time.Time
+	expiryIndex int
+
+	// used by the lru policy
+	element *list.Element
+
+	// used by the lfu policy
+	frequency uint64
+	tick      uint64
+	index     int
+}
+
+// expired check whether the entry is already expired.
+func (entry *memoryEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+// evictionPolicy keeps track of entries usage and decide which entry to evict.
+type evictionPolicy interface {
+	added(entry *memoryEntry)
+	accessed(entry *memoryEntry)
+	removed(entry *memoryEntry)
+	victim() *memoryEntry
+	clear()
+}
+
+func newEvictionPolicy(name string) evictionPolicy {
+	switch strings.ToLower(name) {
+	case EvictLFU:
+		return &lfuPolicy{}
+	case EvictNone:
+		return nil
+	default:
+		return &lruPolicy{order: list.New()}
+	}
+}
+
+// lruPolicy keeps the entries in a list, most recently used entry at the front.
+type lruPolicy struct {
+	order *list.List
+}
+
+func (p *lruPolicy) added(entry *memoryEntry) {
+	entry.element = p.order.PushFront(entry)
+}
+
+func (p *lruPolicy) accessed(entry *memoryEntry) {
+	p.order.MoveToFront(entry.element)
+}
+
+func (p *lruPolicy) removed(entry *memoryEntry) {
+	p.order.Remove(entry.element)
+	entry.element = nil
+}
+
+func (p *lruPolicy) victim() *memoryEntry {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(*memoryEntry)
+	}
+	return nil
+}
+
+func (p *lruPolicy) clear() {
+	p.order.Init()
+}
+
+// lfuPolicy keeps the entries in a min-heap ordered by access frequency.
+// Entries with the same frequency are ordered by their last access, the oldest first.
+type lfuPolicy struct {
+	entries lfuHeap
+	ticks   uint64
+}
+
+func (p *lfuPolicy) added(entry *memoryEntry) {
+	p.ticks++
+	entry.frequency = 1
+	entry.tick = p.ticks
+	heap.Push(&p.entries, entry)
+}
+
+func (p *lfuPolicy) accessed(entry *memoryEntry) {
+	p.ticks++
+	entry.frequency++
+	entry.tick = p.ticks
+	heap.Fix(&p.entries, entry.index)
+}
+
+func (p *lfuPolicy) removed(entry *memoryEntry) {
+	heap.Remove(&p.entries, entry.index)
+}
+
+func (p *lfuPolicy) victim() *memoryEntry {
+	if len(p.entries) > 0 {
+		return p.entries[0]
+	}
+	return nil
+}
+
+func (p *lfuPolicy) clear() {
+	p.entries = nil
+}
+
+type lfuHeap []*memoryEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].frequency == h[j].frequency {
+		return h[i].tick < h[j].tick
+	}
+	return h[i].frequency < h[j].frequency
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	entry := x.(*memoryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// expiryHeap is a min-heap of entries ordered by their expiry time.
+type expiryHeap []*memoryEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i
+	h[j].expiryIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*memoryEntry)
+	entry.expiryIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.expiryIndex = -1
+	*h = old[:n-1]
+	return entry
+}
@@ -0,0 +1,165 @@
+/*-----------------------------------------------------------------------------------
+  --  RETTER                                                                       --
+  --  Copyright (C) 2021  RETTER's Contributors                                    --
+  --                                                                               --
+  --  This program is free software: you can redistribute it and/or modify         --
+  --  it under the terms of the GNU Affero General Public License as published     --
+  --  by the Free Software Foundation, either version 3 of the License, or         --
+  --  (at your option) any later version.                                          --
+  --                                                                               --
+  --  This program is distributed in the hope that it will be useful,              --
+  --  but WITHOUT ANY WARRANTY; without even the implied warranty of               --
+  --  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the                --
+  --  GNU Affero General Public License for more details.                          --
+  --                                                                               --
+  --  You should have received a copy of the GNU Affero General Public License     --
+  --  along with this program.  If not, see <https:   -- www.gnu.org/licenses/>.   --
+  -----------------------------------------------------------------------------------*/
+
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MemoryStoreName is the name of the default, in process memory, store.
+	MemoryStoreName = "memory"
+)
+
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.RWMutex
+)
+
+func init() {
+	RegisterStore(MemoryStoreName, func(opts Options) (Store, error) {
+		return NewMemoryStoreWithOptions(opts), nil
+	})
+}
+
+// Store is the interface every cache storage backend must implement.
+// A value stored into the Store will be removed automatically once its TTL is passed.
+// A zero or negative TTL means the value will never expire.
+type Store interface {
+	// Set a value into the store identified by the key, with the specified TTL duration.
+	Set(key string, value interface{}, ttl time.Duration)
+
+	// Get a value from the store identified by the key. If reset is true, the entry's
+	// TTL will be reset to the new ttl. Returns nil if the key is not in the store.
+	Get(key string, reset bool, ttl time.Duration) interface{}
+
+	// Delete an entry from the store.
+	Delete(key string)
+
+	// Clear removes all entries from the store.
+	Clear()
+
+	// Size return the number of entries in the store.
+	Size() int
+
+	// Close release the resources held by the store, such as background goroutines.
+	// The store must not be used after it is closed.
+	Close() error
+}
+
+// Options are the settings passed into a store Factory.
+type Options struct {
+	// EvictionPolicy is the name of policy to choose which entry to evict when the store is full,
+	// EvictLRU, EvictLFU or EvictNone.
+	EvictionPolicy string
+
+	// MaxEntries is the maximum number of entries in the store, 0 means unlimited.
+	MaxEntries int
+
+	// MaxBytes is the maximum total size of entries in the store, 0 means unlimited.
+	MaxBytes int64
+
+	// Dir is the directory where a persistent store keeps its data.
+	Dir string
+
+	// Codec serialize the values for a persistent store.
+	Codec Codec
+
+	// CompactInterval is how often a persistent store removes its expired data.
+	CompactInterval time.Duration
+
+	// OnEvict is called with the key of each entry the store removed by itself, as it was evicted or expired.
+	// It's called outside of the store's lock, so it may use the store.
+	OnEvict func(key string)
+}
+
+// Stats is a snapshot of a store's statistic.
+type Stats struct {
+	Entries     int
+	Bytes       int64
+	Evictions   uint64
+	Expirations uint64
+	Rejected    uint64
+}
+
+// StatsReporter is implemented by a Store that is able to report its statistic.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// EntryInfo describes an entry in a store, without its value.
+type EntryInfo struct {
+	Key     string
+	Stored  time.Time
+	Expires time.Time
+	Size    int64
+}
+
+// Lister is implemented by a Store that is able to enumerate its entries.
+type Lister interface {
+	// Entries return the description of every non expired entry in the store, in no particular order.
+	Entries() []EntryInfo
+}
+
+// Sizer is implemented by values that know their own size in bytes.
+// The size is used by the store to enforce its MaxBytes limit.
+type Sizer interface {
+	ByteSize() int64
+}
+
+// SizeOf return the size of a value to be stored. Values that are neither Sizer, string
+// nor byte slice are considered to have zero size.
+func SizeOf(value interface{}) int64 {
+	switch v := value.(type) {
+	case Sizer:
+		return v.ByteSize()
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	default:
+		return 0
+	}
+}
+
+// Factory is a function that creates a new Store instance.
+type Factory func(opts Options) (Store, error)
+
+// RegisterStore register a store Factory under a name, so it can be selected from configuration.
+// Registering a factory using an existing name will replace the old one.
+func RegisterStore(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	factories[strings.ToLower(name)] = factory
+}
+
+// NewStore creates a new Store using the factory registered under the specified name.
+func NewStore(name string, opts Options) (Store, error) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	if factory, ok := factories[strings.ToLower(name)]; ok {
+		return factory(opts)
+	}
+	return nil, fmt.Errorf("cache store \"%s\" is not registered", name)
+}
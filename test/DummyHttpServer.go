@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,11 +22,17 @@ var (
 		slowest:         1 * time.Second,
 		failProbability: 0,
 	}
-	RequestCount = 0
+	RequestCount uint64
 	LongBody     = strings.Repeat("This is a dummy line\n", 300)
+
+	serverLock sync.Mutex
+	serverDone chan bool
 )
 
 func SetFastest(f, s time.Duration) {
+	dummyHttpHandler.mutex.Lock()
+	defer dummyHttpHandler.mutex.Unlock()
+
 	dummyHttpHandler.fastest = f
 	dummyHttpHandler.slowest = s
 	if dummyHttpHandler.fastest > dummyHttpHandler.slowest {
@@ -34,10 +43,16 @@ func SetFastest(f, s time.Duration) {
 }
 
 func FailProbability(f float64) {
+	dummyHttpHandler.mutex.Lock()
+	defer dummyHttpHandler.mutex.Unlock()
+
 	dummyHttpHandler.failProbability = f
 }
 
 func StartDummyServer(addr string, standalone bool) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
 	if DummyServerAlive {
 		return
 	}
@@ -57,31 +72,52 @@ func StartDummyServer(addr string, standalone bool) {
 			log.Println(err)
 		}
 	} else {
-		go func() {
-			fmt.Printf("Dummyserver is listening on : %s\n", DummyServer.Addr)
-			DummyServerAlive = true
-			if err := DummyServer.ListenAndServe(); err != nil {
+		// listen before returning, so the server is ready to accept calls
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Printf("Dummyserver is listening on : %s\n", DummyServer.Addr)
+		DummyServerAlive = true
+		done := make(chan bool)
+		serverDone = done
+		go func(server *http.Server) {
+			if err := server.Serve(listener); err != nil {
 				log.Println(err)
 			}
+			serverLock.Lock()
 			DummyServerAlive = false
-		}()
+			serverLock.Unlock()
+			close(done)
+		}(DummyServer)
 	}
 }
 
 func StopDummyServer() {
-	DummyServer.Shutdown(context.Background())
+	serverLock.Lock()
+	server, done := DummyServer, serverDone
+	serverLock.Unlock()
+
+	server.Shutdown(context.Background())
+	if done != nil {
+		<-done
+	}
 }
 
 type DummyHttpHandler struct {
 	fastest         time.Duration
 	slowest         time.Duration
 	failProbability float64
+	mutex           sync.RWMutex
 }
 
 func (dhh *DummyHttpHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	RequestCount++
-	rc := RequestCount
+	rc := atomic.AddUint64(&RequestCount, 1)
 	if req.URL.Path == "/set" {
+		dhh.mutex.Lock()
+		defer dhh.mutex.Unlock()
+
 		newFast := req.URL.Query().Get("f")
 		newSlow := req.URL.Query().Get("s")
 		newError := req.URL.Query().Get("e")
@@ -114,12 +150,19 @@ func (dhh *DummyHttpHandler) ServeHTTP(res http.ResponseWriter, req *http.Reques
 		res.WriteHeader(http.StatusOK)
 		res.Write(ToReturn)
 	} else {
-		dur := dhh.slowest - dhh.fastest
-		sleep := dhh.fastest + time.Duration(rand.Int63n(int64(dur)))
+		dhh.mutex.RLock()
+		fastest, slowest, failProbability := dhh.fastest, dhh.slowest, dhh.failProbability
+		dhh.mutex.RUnlock()
+
+		dur := slowest - fastest
+		sleep := fastest
+		if dur > 0 {
+			sleep += time.Duration(rand.Int63n(int64(dur)))
+		}
 		time.Sleep(sleep)
 		res.Header().Set("Content-Type", "text/plain")
 		failRandom := rand.Float64()
-		if failRandom < dhh.failProbability {
+		if failRandom < failProbability {
 			ToReturn := []byte(fmt.Sprintf("ERROR %d", rc))
 			res.Header().Set("Content-Length", strconv.Itoa(len(ToReturn)))
 			res.WriteHeader(http.StatusInternalServerError)